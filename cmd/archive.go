@@ -0,0 +1,223 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// isArchive は path がレビュー対象として展開できるアーカイブかを返す。
+func isArchive(path string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range []string{".zip", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(lower, ext) {
+			if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// アーカイブ展開の既定の上限。zip / tar.gz 爆弾で一時ディレクトリが
+// 埋まらないよう、展開する合計バイト数とエントリ数を制限する。
+const (
+	defaultMaxArchiveBytes   = 1 << 30
+	defaultMaxArchiveEntries = 100000
+)
+
+// archiveLimits は展開中の上限と、これまでに展開した量を表す。
+type archiveLimits struct {
+	fileBytes  int64 // 1 ファイルの上限（max_file_bytes、0 なら無制限）
+	totalBytes int64 // 展開する合計の上限（max_archive_bytes）
+	entries    int   // 展開するファイル数の上限（max_archive_entries）
+
+	written int64
+	files   int
+}
+
+// newArchiveLimits は設定から展開の上限を読み込む。
+func newArchiveLimits() *archiveLimits {
+	l := &archiveLimits{
+		fileBytes:  viper.GetInt64("max_file_bytes"),
+		totalBytes: defaultMaxArchiveBytes,
+		entries:    defaultMaxArchiveEntries,
+	}
+	if viper.IsSet("max_archive_bytes") {
+		l.totalBytes = viper.GetInt64("max_archive_bytes")
+	}
+	if viper.IsSet("max_archive_entries") {
+		l.entries = viper.GetInt("max_archive_entries")
+	}
+	return l
+}
+
+// extractArchive は zip / tar.gz アーカイブを一時ディレクトリへ展開し、その
+// パスを返す。展開先の外を指すエントリやシンボリックリンクなど、通常の
+// ファイル以外は展開しない。max_file_bytes を超えるエントリは読み飛ばし、
+// 合計が max_archive_bytes、ファイル数が max_archive_entries を超えた時点で
+// 展開を中止する。不要になったら呼び出し側で削除する。
+func extractArchive(path string) (string, error) {
+	dir, err := os.MkdirTemp("", "ollama_review-*")
+	if err != nil {
+		return "", err
+	}
+	limits := newArchiveLimits()
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		err = extractZip(path, dir, limits)
+	} else {
+		err = extractTarGz(path, dir, limits)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("extract %s: %w", path, err)
+	}
+	log.Printf("Extracted %s to %s (%d files, %d bytes)", path, dir, limits.files, limits.written)
+	return dir, nil
+}
+
+// archiveTarget はアーカイブ内のエントリ名から展開先のパスを返す。展開先の
+// 外を指す名前では ok が false になる。
+func archiveTarget(dir, name string) (string, bool) {
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dir, target)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return target, true
+}
+
+// extract は 1 エントリを上限の範囲で target へ書き出す。size はヘッダに
+// 記録されたサイズで、実際の内容がそれを偽っていても上限を超えて書かない。
+func (l *archiveLimits) extract(dir, name string, size int64, open func() (io.ReadCloser, error)) error {
+	target, ok := archiveTarget(dir, name)
+	if !ok {
+		log.Printf("Skipping archive entry %s: outside the archive root", name)
+		return nil
+	}
+	if l.fileBytes > 0 && size > l.fileBytes {
+		log.Printf("Skipping archive entry %s: %d bytes exceeds max_file_bytes", name, size)
+		return nil
+	}
+	if l.files++; l.entries > 0 && l.files > l.entries {
+		return fmt.Errorf("archive has more than %d files (max_archive_entries)", l.entries)
+	}
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	// ファイルと合計のうち小さい方の残りに 1 バイト足した分だけ読み、超過を検出する
+	limit := int64(-1)
+	if l.fileBytes > 0 {
+		limit = l.fileBytes
+	}
+	if l.totalBytes > 0 && (limit < 0 || l.totalBytes-l.written < limit) {
+		limit = l.totalBytes - l.written
+	}
+	src := io.Reader(r)
+	if limit >= 0 {
+		src = io.LimitReader(r, limit+1)
+	}
+	n, err := io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if limit >= 0 && n > limit {
+		if l.totalBytes > 0 && l.written+n > l.totalBytes {
+			return fmt.Errorf("archive expands to more than %d bytes (max_archive_bytes)", l.totalBytes)
+		}
+		log.Printf("Skipping archive entry %s: exceeds max_file_bytes", name)
+		return os.Remove(target)
+	}
+	l.written += n
+	return nil
+}
+
+// extractZip は zip アーカイブの通常ファイルを dir へ展開する。
+func extractZip(path, dir string, limits *archiveLimits) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, zf := range zr.File {
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+		if err := limits.extract(dir, zf.Name, int64(zf.UncompressedSize64), zf.Open); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractTarGz は gzip 圧縮した tar アーカイブの通常ファイルを dir へ展開する。
+func extractTarGz(path, dir string, limits *archiveLimits) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		open := func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }
+		if err := limits.extract(dir, hdr.Name, hdr.Size, open); err != nil {
+			return err
+		}
+	}
+}
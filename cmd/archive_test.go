@@ -0,0 +1,140 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeZip は entries（名前 → 内容）を持つ zip を作成する。
+func writeZip(t *testing.T, path string, entries map[string][]byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range entries {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTarGz は entries（名前 → 内容）を持つ tar.gz を作成する。
+func writeTarGz(t *testing.T, path string, entries map[string][]byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range entries {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write(content)
+	}
+	tw.Close()
+	gz.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReviewZipArchive(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "src.zip")
+	writeZip(t, archive, map[string][]byte{
+		"pkg/a.py":     []byte("def zipped(x):\n    return x\n"),
+		"README.txt":   []byte("not code"),
+		"../escape.py": []byte("def escaped():\n    pass\n"),
+	})
+	report := reviewEcho(t, archive, nil)
+	if !strings.Contains(report, "## src.zip/pkg/a.py - zipped") {
+		t.Errorf("archive source not reviewed under the archive name:\n%s", report)
+	}
+	if strings.Contains(report, "escaped") {
+		t.Errorf("entry outside the archive root was reviewed:\n%s", report)
+	}
+}
+
+func TestReviewTarGzArchive(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "src.tar.gz")
+	writeTarGz(t, archive, map[string][]byte{"main.go": []byte("package main\n\nfunc Tarred() {}\n")})
+	report := reviewEcho(t, archive, nil)
+	if !strings.Contains(report, "## src.tar.gz/main.go - Tarred") {
+		t.Errorf("tar.gz source not reviewed:\n%s", report)
+	}
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	bomb := bytes.Repeat([]byte{0}, 4<<20) // 圧縮すると数 KB になる
+	archive := filepath.Join(t.TempDir(), "bomb.zip")
+	writeZip(t, archive, map[string][]byte{"a.py": []byte("def a():\n    pass\n"), "zeros.py": bomb})
+
+	t.Run("max_file_bytes skips the entry", func(t *testing.T) {
+		resetConfig(t, map[string]any{"max_file_bytes": 1024})
+		dir, err := extractArchive(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if _, err := os.Stat(filepath.Join(dir, "zeros.py")); !os.IsNotExist(err) {
+			t.Errorf("oversized entry was extracted (err=%v)", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "a.py")); err != nil {
+			t.Errorf("small entry missing: %v", err)
+		}
+	})
+	t.Run("max_archive_bytes aborts", func(t *testing.T) {
+		resetConfig(t, map[string]any{"max_archive_bytes": 1 << 20})
+		if dir, err := extractArchive(archive); err == nil {
+			os.RemoveAll(dir)
+			t.Fatal("extractArchive succeeded past max_archive_bytes")
+		}
+	})
+	t.Run("max_archive_entries aborts", func(t *testing.T) {
+		resetConfig(t, map[string]any{"max_archive_entries": 1})
+		if dir, err := extractArchive(archive); err == nil {
+			os.RemoveAll(dir)
+			t.Fatal("extractArchive succeeded past max_archive_entries")
+		}
+	})
+}
+
+func TestReviewArchiveFailsPastLimit(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "bomb.tar.gz")
+	writeTarGz(t, archive, map[string][]byte{"zeros.py": bytes.Repeat([]byte{0}, 2<<20)})
+	echoConfig(t, map[string]any{"max_archive_bytes": 1 << 20})
+	if err := Review(context.Background(), archive, filepath.Join(t.TempDir(), "r.md")); err == nil {
+		t.Fatal("Review succeeded past max_archive_bytes")
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// batchMarkerFormat はまとめたプロンプト内で各チャンクの先頭に置く区切り行。
+// モデルにも同じ行で各レビューを始めるよう指示し、応答の分割に用いる。
+const batchMarkerFormat = "=== chunk %d: %s ==="
+
+// batchMarkerPattern は応答中の区切り行を表す。
+var batchMarkerPattern = regexp.MustCompile(`(?m)^\s*=== chunk (\d+):.*===\s*$`)
+
+// batchInstruction はまとめたプロンプトに添えるシステム指示。
+const batchInstruction = "The code contains %d chunks, each introduced by a line like \"=== chunk N: name ===\". " +
+	"Review each chunk separately and begin each review with the same marker line."
+
+// batchReview は batch_size でまとめてレビューしたチャンク 1 つぶんの結果。
+type batchReview struct {
+	res   reviewResult
+	model string
+}
+
+// joinBatch は複数のチャンクを区切り行付きで 1 つのチャンクに連結する。
+// 近傍のシグネチャや blame などの文脈は含めない。
+func joinBatch(fns []Chunk) Chunk {
+	names := make([]string, len(fns))
+	parts := make([]string, len(fns))
+	joined := Chunk{StartLine: fns[0].StartLine, EndLine: fns[len(fns)-1].EndLine, Lang: fns[0].Lang, batch: len(fns)}
+	for i, fn := range fns {
+		names[i] = fn.Name
+		parts[i] = fmt.Sprintf(batchMarkerFormat, i+1, fn.Name) + "\n" + string(fn.Code)
+		joined.Complexity = max(joined.Complexity, fn.Complexity)
+	}
+	joined.Name = strings.Join(names, ", ")
+	joined.Code = []byte(strings.Join(parts, "\n\n"))
+	return joined
+}
+
+// splitBatch は区切り行ごとに応答を n 個のレビューへ分割する。
+// 各チャンクのレビューがちょうど 1 つずつ見つからない場合は nil を返す。
+func splitBatch(raw string, n int) []string {
+	locs := batchMarkerPattern.FindAllStringSubmatchIndex(raw, -1)
+	if len(locs) != n {
+		return nil
+	}
+	parts := make([]string, n)
+	for i, loc := range locs {
+		k, err := strconv.Atoi(raw[loc[2]:loc[3]])
+		if err != nil || k < 1 || k > n || parts[k-1] != "" {
+			return nil
+		}
+		end := len(raw)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		parts[k-1] = strings.TrimSpace(raw[loc[1]:end])
+	}
+	return parts
+}
+
+// reviewBatches は funcs を先頭から最大 size 個ずつまとめてレビューし、
+// チャンクの添字ごとの結果を返す。プロンプトの上限を超えないようにまとめる
+// 数を減らし、1 個しかまとめられない場合や応答を分割できなかった場合は
+// 結果に含めず、呼び出し側で個別にレビューさせる。
+func (r *reviewRun) reviewBatches(ctx context.Context, path, ext string, funcs []Chunk, size int) map[int]batchReview {
+	results := map[int]batchReview{}
+	for start := 0; start < len(funcs) && ctx.Err() == nil; {
+		end := start + 1
+		// 言語の異なるチャンク（Markdown のコードブロックなど）は同じ要求にまとめない
+		for end < len(funcs) && end-start < size && funcs[end].Lang == funcs[start].Lang {
+			prompt, err := buildPrompt(r.guideline, chunkLang(ext, funcs[start]), joinBatch(funcs[start:end+1]))
+			if err != nil || promptOverLimit(prompt) != nil {
+				break
+			}
+			end++
+		}
+		if end-start > 1 {
+			batch := joinBatch(funcs[start:end])
+			route := selectRoute(r.routes, r.model, ext, len(batch.Code))
+			model := route.Model
+			res, err := r.reviewWithRetry(ctx, r.routeClient(route), model, r.guideline, chunkLang(ext, batch), batch)
+			switch parts := splitBatch(res.Raw, batch.batch); {
+			case err != nil:
+				log.Printf("Batch review error %s[%s]: %v; reviewing individually", path, batch.Name, err)
+			case parts == nil:
+				log.Printf("Batch response for %s[%s] could not be split; reviewing individually", path, batch.Name)
+			default:
+				for k, part := range parts {
+					br := batchReview{res: reviewResult{Raw: part, Truncated: res.Truncated}, model: model}
+					if k == 0 {
+						// トークン数は 1 回の要求ぶんなので先頭のチャンクにだけ計上する
+						br.res.PromptTokens, br.res.OutputTokens = res.PromptTokens, res.OutputTokens
+					}
+					results[start+k] = br
+				}
+			}
+		}
+		start = end
+	}
+	return results
+}
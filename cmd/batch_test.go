@@ -0,0 +1,55 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReviewBatchSharesOneRequest(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def one():\n    return 1\n\n\ndef two():\n    return 2\n"})
+	ollama := newFakeOllama(t, 0)
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "batch_size": 2})
+	report := runReview(t, dir)
+	reqs := ollama.chatRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d chat requests, want 1 for a batch of 2", len(reqs))
+	}
+	if prompt := reqs[0].Messages[len(reqs[0].Messages)-1].Content; !strings.Contains(prompt, "=== chunk 1: one ===") || !strings.Contains(prompt, "=== chunk 2: two ===") {
+		t.Errorf("batched prompt lacks the chunk markers:\n%s", prompt)
+	}
+	// 偽サーバはプロンプトをそのまま返すため、区切り行で分けた各レビューには
+	// そのチャンクのコードだけが含まれる
+	i, j := strings.Index(report, "- one ("), strings.Index(report, "- two (")
+	if i < 0 || j < i {
+		t.Fatalf("per-function sections missing:\n%s", report)
+	}
+	first, second := report[i:j], report[j:]
+	if !strings.Contains(first, "return 1") || strings.Contains(first, "return 2") {
+		t.Errorf("review attributed to one is wrong:\n%s", first)
+	}
+	if !strings.Contains(second, "return 2") || strings.Contains(second, "return 1") {
+		t.Errorf("review attributed to two is wrong:\n%s", second)
+	}
+}
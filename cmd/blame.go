@@ -0,0 +1,162 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gitBlame は git blame --porcelain を実行して出力を返す。テストなどから
+// 差し替えられるよう変数として定義している。
+var gitBlame = func(path string, start, end int) (string, error) {
+	out, err := exec.Command("git", "-C", filepath.Dir(path), "blame", "--porcelain",
+		"-L", fmt.Sprintf("%d,%d", start, end), "--", filepath.Base(path)).Output()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// gitLogRange は git log -L で指定行範囲の変更履歴を直近 n コミットぶん返す。
+// gitBlame と同じくテストなどから差し替えられるよう変数として定義している。
+var gitLogRange = func(path string, start, end, n int) (string, error) {
+	out, err := exec.Command("git", "-C", filepath.Dir(path), "log", "--format=%H",
+		fmt.Sprintf("--max-count=%d", n), "-L", fmt.Sprintf("%d,%d:%s", start, end, filepath.Base(path))).Output()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// churnCount は指定行範囲を変更した直近 n コミット中のコミット数を返す。
+// git が使えない場合や追跡されていないファイルでは 0 を返す。
+func churnCount(path string, start, end, n int) int {
+	if start <= 0 || end < start {
+		return 0
+	}
+	out, err := gitLogRange(path, start, end, n)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		// 差分の行は +/-/@@ などで始まるため、40 桁の 16 進だけの行がコミット
+		if line := sc.Text(); len(line) == 40 && strings.Trim(line, "0123456789abcdef") == "" {
+			count++
+		}
+	}
+	return count
+}
+
+// gitAvailable は git コマンドが利用可能かを判定する。
+func gitAvailable() bool {
+	_, err := exec.LookPath("git")
+	return err == nil
+}
+
+// blameCommit は porcelain 出力から読み取ったコミット情報。
+type blameCommit struct {
+	sha     string
+	author  string
+	time    int64
+	summary string
+}
+
+// blameSummary は指定行範囲を最後に変更したコミットの作者と概要を 1 行で返す。
+// git が使えない場合や追跡されていないファイルでは空文字を返す。
+func blameSummary(path string, start, end int) string {
+	if start <= 0 || end < start {
+		return ""
+	}
+	out, err := gitBlame(path, start, end)
+	if err != nil {
+		return ""
+	}
+	latest := parseBlameLatest(out)
+	if latest == nil {
+		return ""
+	}
+	short := latest.sha
+	if len(short) > 8 {
+		short = short[:8]
+	}
+	return fmt.Sprintf("last changed by %s in %s (%s): %s",
+		latest.author, short, time.Unix(latest.time, 0).UTC().Format("2006-01-02"), latest.summary)
+}
+
+// uncommittedSHA は git blame がまだコミットされていない行に付ける SHA。
+const uncommittedSHA = "0000000000000000000000000000000000000000"
+
+// parseBlameLatest は porcelain 形式の出力から author-time が最も新しい
+// コミットを返す。作業ツリーでの未コミットの変更（"Not Committed Yet"）は
+// コミットではないため除く。
+func parseBlameLatest(out string) *blameCommit {
+	commits := map[string]*blameCommit{}
+	var cur *blameCommit
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "\t") {
+			continue // ソース行本体
+		}
+		key, val, _ := strings.Cut(line, " ")
+		if cur == nil && len(key) != 40 {
+			// 最初のヘッダ行より前の行（途中から切れた出力など）は読み飛ばす
+			continue
+		}
+		switch key {
+		case "author":
+			cur.author = val
+		case "author-time":
+			cur.time, _ = strconv.ParseInt(val, 10, 64)
+		case "summary":
+			cur.summary = val
+		default:
+			if len(key) == 40 {
+				// "<sha> <元の行> <現在の行> [<行数>]" のヘッダ行
+				if c, ok := commits[key]; ok {
+					cur = c
+				} else {
+					cur = &blameCommit{sha: key}
+					commits[key] = cur
+				}
+			}
+		}
+	}
+	var latest *blameCommit
+	for _, c := range commits {
+		if c.sha == uncommittedSHA {
+			continue
+		}
+		if latest == nil || c.time > latest.time {
+			latest = c
+		}
+	}
+	return latest
+}
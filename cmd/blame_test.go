@@ -0,0 +1,147 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// blamePorcelain は a.py の 2 行に対する git blame --porcelain の出力。
+// 2 行目は未コミットの変更で、コミット済みの行より新しい。
+const blamePorcelain = `1111111111111111111111111111111111111111 1 1 1
+author Alice
+author-time 1700000000
+summary Add f
+filename a.py
+	def f():
+0000000000000000000000000000000000000000 2 2 1
+author Not Committed Yet
+author-time 1800000000
+summary Version of a.py from a.py
+filename a.py
+	    return 1
+`
+
+func TestParseBlameLatestSkipsUncommitted(t *testing.T) {
+	c := parseBlameLatest(blamePorcelain)
+	if c == nil || c.author != "Alice" || c.summary != "Add f" {
+		t.Fatalf("parseBlameLatest = %+v, want the Alice commit", c)
+	}
+	uncommitted := blamePorcelain[strings.Index(blamePorcelain, uncommittedSHA):]
+	if c := parseBlameLatest(uncommitted); c != nil {
+		t.Errorf("parseBlameLatest returned %+v for uncommitted lines only", c)
+	}
+}
+
+func TestParseBlameLatestMalformed(t *testing.T) {
+	// 途中から切れた出力や壊れた出力でも異常終了しない
+	for _, out := range []string{
+		"",
+		"author Alice\nauthor-time 1700000000\nsummary Add f\n",
+		"summary Add f\n" + blamePorcelain,
+		"garbage line\n\tdef f():\n",
+		"1111111111111111111111111111111111111111 1 1 1\nauthor-time not-a-number\n",
+	} {
+		c := parseBlameLatest(out)
+		if strings.HasPrefix(out, "summary") && (c == nil || c.author != "Alice") {
+			t.Errorf("parseBlameLatest(%q) = %+v, want the Alice commit after the stray line", out, c)
+		}
+	}
+}
+
+// stubGitBlame は gitBlame を blamePorcelain を返す関数に差し替え、呼び出し先の
+// ファイル名を記録する。
+func stubGitBlame(t *testing.T) *[]string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	var mu sync.Mutex
+	var calls []string
+	orig := gitBlame
+	gitBlame = func(path string, start, end int) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, filepath.Base(path))
+		return blamePorcelain, nil
+	}
+	t.Cleanup(func() { gitBlame = orig })
+	return &calls
+}
+
+func TestReviewIncludesBlameOnlyForReviewedChunks(t *testing.T) {
+	calls := stubGitBlame(t)
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.py": "def untouched():\n    return 1\n\ndef edited():\n    return 2\n"})
+	patch := filepath.Join(t.TempDir(), "change.diff")
+	if err := os.WriteFile(patch, []byte("--- a/a.py\n+++ b/a.py\n@@ -5 +5 @@\n-    return 0\n+    return 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	echoConfig(t, map[string]any{"include_blame": true, "patch": patch})
+	guideline := filepath.Join(t.TempDir(), "guideline.tmpl")
+	if err := os.WriteFile(guideline, []byte("{{.code}}\nblame: {{.blame}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("guideline", guideline)
+	report := runReview(t, root)
+	if !strings.Contains(report, "blame: last changed by Alice in 11111111 (2023-11-14): Add f") {
+		t.Errorf("blame variable not populated from the committed line:\n%s", report)
+	}
+	if len(*calls) != 1 {
+		t.Errorf("git blame ran %d times, want once for the changed function", len(*calls))
+	}
+}
+
+func TestReviewMinChurnSelectsFrequentlyChangedFunctions(t *testing.T) {
+	if !gitAvailable() {
+		t.Skip("git not available")
+	}
+	sha := func(c byte) string { return strings.Repeat(string(c), 40) + "\n" }
+	var commits []int
+	orig := gitLogRange
+	gitLogRange = func(path string, start, end, n int) (string, error) {
+		commits = append(commits, n)
+		if start == 1 {
+			// hot は 3 コミットで変更された
+			return sha('a') + "@@ -1 +1 @@\n" + sha('b') + sha('c'), nil
+		}
+		return sha('d'), nil
+	}
+	t.Cleanup(func() { gitLogRange = orig })
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def hot():\n    return 1\n\n\ndef cold():\n    return 2\n"})
+	report := reviewEcho(t, dir, map[string]any{"min_churn": 2, "churn_commits": 20})
+	if !strings.Contains(report, "def hot") || strings.Contains(report, "def cold") {
+		t.Errorf("functions not selected by churn:\n%s", report)
+	}
+	if !slices.Equal(commits, []int{20, 20}) {
+		t.Errorf("history requested with commits %v, want churn_commits 20 per function", commits)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/spf13/viper"
+)
+
+// concurrencyAuto は concurrency に指定するとモデルの大きさからワーカー数を
+// 選ぶ値。
+const concurrencyAuto = "auto"
+
+// autoConcurrency は concurrency: auto で、パラメータ数（10 億単位）が
+// maxParams 以下のモデルに選ぶワーカー数。大きなモデルほど 1 要求あたりの
+// メモリと計算量が大きいため控えめにする。どれにも当てはまらなければ 1。
+var autoConcurrency = []struct {
+	maxParams float64
+	workers   int
+}{
+	{8, 4},
+	{20, 2},
+}
+
+// resolveConcurrency は concurrency の設定から同時にレビューするチャンク数を
+// 決める。数値はそのまま使い、"auto" は client.Show で得たモデルの
+// パラメータ数から autoConcurrency に従って選ぶ（CPU 数が上限）。モデルの情報が
+// 得られない場合は 1 とする。未指定なら 1。
+func resolveConcurrency(ctx context.Context, client *api.Client, model string) (int, error) {
+	v := strings.TrimSpace(viper.GetString("concurrency"))
+	if v == "" {
+		return 1, nil
+	}
+	if !strings.EqualFold(v, concurrencyAuto) {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid concurrency %q (want a positive integer or auto)", v)
+		}
+		return n, nil
+	}
+	n := 1
+	if model == echoModel {
+		log.Printf("concurrency: auto resolved to %d (model %s)", n, model)
+		return n, nil
+	}
+	resp, err := client.Show(ctx, &api.ShowRequest{Model: model})
+	if err != nil {
+		log.Printf("concurrency: auto could not inspect model %s: %v; using %d", model, err, n)
+		return n, nil
+	}
+	size := resp.Details.ParameterSize
+	if params, ok := parseParameterSize(size); ok {
+		for _, a := range autoConcurrency {
+			if params <= a.maxParams {
+				n = min(a.workers, runtime.NumCPU())
+				break
+			}
+		}
+	}
+	log.Printf("concurrency: auto resolved to %d (model %s, %s parameters)", n, model, size)
+	return n, nil
+}
+
+// parseParameterSize は Ollama の parameter_size（"7B"、"13.0B"、"350M" など）を
+// 10 億単位の数値に変換する。
+func parseParameterSize(size string) (float64, bool) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	unit := 1.0 // 10 億あたりの単位数
+	switch {
+	case strings.HasSuffix(size, "B"):
+		size = strings.TrimSuffix(size, "B")
+	case strings.HasSuffix(size, "M"):
+		size, unit = strings.TrimSuffix(size, "M"), 1000
+	default:
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(size, 64)
+	if err != nil || f <= 0 {
+		return 0, false
+	}
+	return f / unit, true
+}
@@ -0,0 +1,98 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestResolveConcurrency(t *testing.T) {
+	ollama := newFakeOllama(t, 0)
+	ollama.sizes["small"] = "7.6B"
+	ollama.sizes["medium"] = "13B"
+	ollama.sizes["large"] = "70B"
+	tests := []struct {
+		setting any
+		model   string
+		want    int
+	}{
+		{nil, "small", 1},
+		{3, "large", 3},
+		{"2", "small", 2},
+		{"auto", "small", min(4, runtime.NumCPU())},
+		{"auto", "medium", min(2, runtime.NumCPU())},
+		{"auto", "large", 1},
+		{"auto", "missing", 1},
+		{"auto", echoModel, 1},
+	}
+	for _, tt := range tests {
+		resetConfig(t, map[string]any{"OllamaHost": ollama.URL, "concurrency": tt.setting})
+		client, err := newOllamaClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := resolveConcurrency(t.Context(), client, tt.model)
+		if err != nil || got != tt.want {
+			t.Errorf("concurrency=%v model=%s: got %d, %v; want %d", tt.setting, tt.model, got, err, tt.want)
+		}
+	}
+	for _, bad := range []any{"many", 0, -2} {
+		resetConfig(t, map[string]any{"concurrency": bad})
+		if _, err := resolveConcurrency(t.Context(), nil, "small"); err == nil {
+			t.Errorf("concurrency=%v accepted", bad)
+		}
+	}
+}
+
+func TestParseParameterSize(t *testing.T) {
+	tests := map[string]float64{"7B": 7, "13.0B": 13, "350M": 0.35, " 70b ": 70}
+	for in, want := range tests {
+		if got, ok := parseParameterSize(in); !ok || got != want {
+			t.Errorf("parseParameterSize(%q) = %v, %v; want %v", in, got, ok, want)
+		}
+	}
+	for _, in := range []string{"", "unknown", "B", "-1B"} {
+		if _, ok := parseParameterSize(in); ok {
+			t.Errorf("parseParameterSize(%q) accepted", in)
+		}
+	}
+}
+
+func TestParseWorkers(t *testing.T) {
+	tests := []struct {
+		setting any
+		want    int
+	}{
+		{nil, 1},
+		{0, 1},
+		{3, 3},
+		{"auto", min(runtime.NumCPU(), maxAutoWorkers)},
+		{"AUTO", min(runtime.NumCPU(), maxAutoWorkers)},
+	}
+	for _, tt := range tests {
+		resetConfig(t, map[string]any{"parse_workers": tt.setting})
+		if got := parseWorkers(); got != tt.want {
+			t.Errorf("parse_workers=%v: got %d, want %d", tt.setting, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// shebangLanguages は shebang のインタプリタ名から langConfig の拡張子への対応。
+var shebangLanguages = map[string]string{
+	"python":  ".py",
+	"python2": ".py",
+	"python3": ".py",
+}
+
+// goPackagePattern は Go の package 句（識別子 1 つ、末尾のコメントは可）。
+// Kotlin や Scala の "package a.b" とは区別する。
+var goPackagePattern = regexp.MustCompile(`^package\s+[A-Za-z_][A-Za-z0-9_]*\s*(//.*)?$`)
+
+// goDeclPattern は package 句に続く Go らしい宣言の書き出し。
+var goDeclPattern = regexp.MustCompile(`^(import\s*[("]|func\s|type\s|var\s|const\s)`)
+
+// detectLanguage は拡張子のないファイルの言語を推定し、対応する langConfig の
+// 拡張子を返す。先頭行の shebang を優先し、なければ先頭付近の内容から簡易的に
+// 判定する。拡張子のあるファイルや判別できない場合は空文字を返す。
+func detectLanguage(path string) string {
+	if filepath.Ext(path) != "" {
+		// .md や .json などを誤って解析しないよう、拡張子のないファイルに限る
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := f.Read(head)
+	head = head[:n]
+	if bytes.IndexByte(head, 0) >= 0 {
+		// NUL を含むものはバイナリとみなす
+		return ""
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(head))
+	first := true
+	pkg := "" // 見つかった package 句から推定した拡張子
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if first && strings.HasPrefix(line, "#!") {
+			return shebangLanguage(line)
+		}
+		first = false
+		if line == "" || strings.HasPrefix(line, "//") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		switch {
+		case pkg == ".go":
+			// Go の package 句の後には Go の宣言が続くことを確かめる
+			if goDeclPattern.MatchString(line) {
+				return ".go"
+			}
+			return ""
+		case strings.HasPrefix(line, "package ") && strings.HasSuffix(line, ";"):
+			return ".java"
+		case goPackagePattern.MatchString(line):
+			pkg = ".go"
+		default:
+			return ""
+		}
+	}
+	return pkg
+}
+
+// shebangLanguage は "#!/usr/bin/env python3" のような行からインタプリタを
+// 取り出し、対応する拡張子を返す。
+func shebangLanguage(line string) string {
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) == 0 {
+		return ""
+	}
+	interp := filepath.Base(fields[0])
+	if interp == "env" {
+		// env の後ろのオプション（-S など）を読み飛ばす
+		interp = ""
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") {
+				interp = f
+				break
+			}
+		}
+	}
+	return shebangLanguages[interp]
+}
@@ -0,0 +1,70 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"script", "#!/usr/bin/env python3\nprint(1)\n", ".py"},
+		{"script-env-S", "#!/usr/bin/env -S python3 -u\nprint(1)\n", ".py"},
+		{"tool", "#!/bin/sh\necho hi\n", ""},
+		{"main", "// Command main.\npackage main\n\nimport \"fmt\"\n", ".go"},
+		{"gofunc", "package util\n\nfunc A() {}\n", ".go"},
+		{"Kotlin", "package app\n\nimport kotlin.math.max\n", ""},
+		{"Scala", "package com.example\n\nobject Main\n", ""},
+		{"Java", "package com.example;\n\nclass A {}\n", ".java"},
+		{"notes.md", "#!/usr/bin/env python3\n", ""},
+		{"data", "\x00\x01binary", ""},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeTree(t, dir, map[string]string{tt.name: tt.content})
+			if got := detectLanguage(filepath.Join(dir, tt.name)); got != tt.want {
+				t.Errorf("detectLanguage = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReviewDetectsExtensionlessPython(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"run":     "#!/usr/bin/env python3\n\ndef detected():\n    return 1\n",
+		"README":  "package notes\n\nsee docs\n",
+		"app.kts": "package app\n\nfun main() {}\n",
+	})
+	report := reviewEcho(t, dir, map[string]any{"detect_language": true, "strict_parse": true})
+	if !strings.Contains(report, "## "+filepath.Join(dir, "run")+" - detected") {
+		t.Errorf("extensionless Python script not reviewed:\n%s", report)
+	}
+	if !strings.Contains(report, "| py | 1 | 1 |") {
+		t.Errorf("script not counted as Python:\n%s", report)
+	}
+}
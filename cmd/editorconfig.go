@@ -0,0 +1,191 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// editorconfigSection は .editorconfig の 1 セクションのうち、言語の指定を
+// 持つものを表す。
+type editorconfigSection struct {
+	pattern *regexp.Regexp
+	lang    string // langConfig の拡張子
+}
+
+// editorconfigFile は 1 つの .editorconfig の解析結果。
+type editorconfigFile struct {
+	root     bool
+	sections []editorconfigSection
+}
+
+// editorconfigCache はディレクトリごとの .editorconfig の解析結果を保持する。
+// prepareFile が並行に呼ばれるため sync.Map を用いる。
+var editorconfigCache sync.Map
+
+// editorconfigLanguage は path から親ディレクトリへ .editorconfig を辿り、
+// language プロパティで指定された言語に対応する langConfig の拡張子を返す。
+// EditorConfig の規則どおり近いファイルほど、同じファイル内では後のセクション
+// ほど優先し、root = true のファイルで探索を打ち切る。指定がなければ空文字を返す。
+func editorconfigLanguage(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+		ec := loadEditorconfig(dir)
+		rel, err := filepath.Rel(dir, abs)
+		if err == nil {
+			rel = filepath.ToSlash(rel)
+			for i := len(ec.sections) - 1; i >= 0; i-- {
+				if ec.sections[i].pattern.MatchString(rel) {
+					return ec.sections[i].lang
+				}
+			}
+		}
+		if ec.root || filepath.Dir(dir) == dir {
+			return ""
+		}
+	}
+}
+
+// loadEditorconfig は dir の .editorconfig を読み込む。存在しない場合や読めない
+// 場合は空の結果を返す。
+func loadEditorconfig(dir string) *editorconfigFile {
+	if v, ok := editorconfigCache.Load(dir); ok {
+		return v.(*editorconfigFile)
+	}
+	ec := &editorconfigFile{}
+	if f, err := os.Open(filepath.Join(dir, ".editorconfig")); err == nil {
+		ec = parseEditorconfig(bufio.NewScanner(f))
+		f.Close()
+	}
+	editorconfigCache.Store(dir, ec)
+	return ec
+}
+
+// parseEditorconfig は .editorconfig を解析し、root の指定と language を持つ
+// セクションを取り出す。言語名は Markdown のコードブロックと同じ名前
+// （python, go, cpp など）で指定し、未対応の言語は無視する。
+func parseEditorconfig(sc *bufio.Scanner) *editorconfigFile {
+	ec := &editorconfigFile{}
+	var glob string
+	inSection := false
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			glob, inSection = line[1:len(line)-1], true
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.ToLower(strings.TrimSpace(value))
+		switch {
+		case !inSection && key == "root":
+			ec.root = value == "true"
+		case inSection && key == "language":
+			lang, ok := fenceLanguages[value]
+			if !ok {
+				continue
+			}
+			if re, err := editorconfigPattern(glob); err == nil {
+				ec.sections = append(ec.sections, editorconfigSection{re, "." + lang})
+			}
+		}
+	}
+	return ec
+}
+
+// editorconfigPattern は EditorConfig のグロブを .editorconfig のある
+// ディレクトリからの相対パスに対する正規表現へ変換する。"/" を含まない
+// グロブは任意の階層のファイル名に一致する。
+func editorconfigPattern(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	if strings.Contains(glob, "/") {
+		glob = strings.TrimPrefix(glob, "/")
+		b.WriteString("^")
+	} else {
+		b.WriteString("(^|/)")
+	}
+	depth := 0 // 開いている {} の数
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end
+		case '{':
+			depth++
+			b.WriteString("(?:")
+		case '}':
+			if depth == 0 {
+				b.WriteString(`\}`)
+				continue
+			}
+			depth--
+			b.WriteString(")")
+		case ',':
+			if depth == 0 {
+				b.WriteString(",")
+				continue
+			}
+			b.WriteString("|")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
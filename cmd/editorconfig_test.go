@@ -0,0 +1,53 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestReviewUsesEditorconfigLanguage(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		".editorconfig":    "root = true\n\n[*.pyx]\nlanguage = python\n\n[tools/*.gotmpl]\nlanguage = go\n",
+		"fast.pyx":         "def fast_path():\n    return 1\n",
+		"tools/gen.gotmpl": "package tools\n\nfunc Generate() {}\n",
+		"other/gen.gotmpl": "package other\n\nfunc Unmapped() {}\n",
+	})
+	templateConfig(t, "lang={{.lang}}\n{{.code}}", map[string]any{"use_editorconfig": true})
+	report := runReview(t, dir)
+	for _, want := range []string{"lang=py\ndef fast_path", "lang=go\nfunc Generate"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report missing %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "Unmapped") {
+		t.Errorf("file outside the mapped glob reviewed:\n%s", report)
+	}
+	viper.Set("use_editorconfig", false)
+	if report := runReview(t, dir); strings.Contains(report, "fast_path") {
+		t.Errorf(".editorconfig mapping used with use_editorconfig disabled:\n%s", report)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import "fmt"
+
+// ParseError はソースコードの構文解析に失敗したことを表す。
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string { return fmt.Sprintf("parse source: %v", e.Err) }
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// TemplateError はガイドラインテンプレートの読み込みまたは実行に失敗した
+// ことを表す。Op は "parse" か "execute"。
+type TemplateError struct {
+	Op  string
+	Err error
+}
+
+func (e *TemplateError) Error() string { return fmt.Sprintf("%s template: %v", e.Op, e.Err) }
+
+func (e *TemplateError) Unwrap() error { return e.Err }
+
+// OllamaError は Ollama API との通信やモデル呼び出しに失敗したことを表す。
+type OllamaError struct {
+	Model string
+	Err   error
+}
+
+func (e *OllamaError) Error() string { return fmt.Sprintf("ollama %s: %v", e.Model, e.Err) }
+
+func (e *OllamaError) Unwrap() error { return e.Err }
+
+// PromptTooLargeError は描画したプロンプトが Key の上限（max_prompt_bytes
+// または max_prompt_tokens）を超えたため、チャンクをレビューせずに読み飛ばした
+// ことを表す。Size と Limit の単位は Key に従う。
+type PromptTooLargeError struct {
+	Size  int
+	Limit int
+	Key   string
+}
+
+func (e *PromptTooLargeError) Error() string {
+	return fmt.Sprintf("prompt size %d exceeds %s (%d)", e.Size, e.Key, e.Limit)
+}
@@ -0,0 +1,77 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"text/template"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+func TestParseErrorFromExtraction(t *testing.T) {
+	// 言語未設定のパーサは構文木を返さず、解析の失敗として扱われる
+	_, _, err := extractFunctions([]byte("def f(): pass\n"), sitter.NewLanguage(nil), "function_definition", nil)
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("extractFunctions error = %v (%T), want *ParseError", err, err)
+	}
+	if !errors.Is(err, sitter.ErrNoLanguage) {
+		t.Errorf("ParseError does not wrap the parser error: %v", err)
+	}
+}
+
+func TestTemplateErrorFromGuideline(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"bad.tmpl": "{{.code"})
+	resetConfig(t, map[string]any{"guideline": filepath.Join(dir, "bad.tmpl")})
+	_, err := loadGuideline("guideline", nil)
+	var te *TemplateError
+	if !errors.As(err, &te) || te.Op != "parse" {
+		t.Errorf("loadGuideline error = %v, want a parse *TemplateError", err)
+	}
+
+	tmpl := template.Must(template.New("g").Option("missingkey=error").Parse(`{{template "missing"}}`))
+	_, err = buildPrompt(tmpl, "py", Chunk{Name: "f", Code: []byte("def f(): pass")})
+	if !errors.As(err, &te) || te.Op != "execute" {
+		t.Errorf("buildPrompt error = %v, want an execute *TemplateError", err)
+	}
+}
+
+func TestOllamaErrorFromReview(t *testing.T) {
+	ollama := newFakeOllama(t, 0)
+	ollama.Close() // 接続できないサーバ
+	resetConfig(t, nil)
+	client, err := newEndpointClient(ollama.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := template.Must(template.New("g").Parse(echoGuideline))
+	_, err = reviewChunk(context.Background(), client, "fake", tmpl, "py", Chunk{Name: "f", Code: []byte("def f(): pass")}, nil)
+	var oe *OllamaError
+	if !errors.As(err, &oe) || oe.Model != "fake" {
+		t.Errorf("reviewChunk error = %v (%T), want *OllamaError for fake", err, err)
+	}
+}
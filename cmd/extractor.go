@@ -0,0 +1,74 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Extractor はソースコードからレビュー単位のチャンクを切り出す関数。
+// 既定の Tree-sitter による関数抽出の代わりに、クラス単位など独自の
+// 抽出ロジックを差し込むために用いる。
+type Extractor func(src []byte) ([]Chunk, error)
+
+var (
+	extractorsMu sync.RWMutex
+	extractors   = map[string]Extractor{}
+)
+
+// RegisterExtractor は拡張子 ext（例: ".py"）に対する独自抽出器を登録する。
+// 登録された拡張子では langConfig の設定より独自抽出器が優先される。
+// fn に nil を渡すと登録を解除する。
+func RegisterExtractor(ext string, fn Extractor) {
+	extractorsMu.Lock()
+	defer extractorsMu.Unlock()
+	if fn == nil {
+		delete(extractors, ext)
+		return
+	}
+	extractors[ext] = fn
+}
+
+// lookupExtractor は拡張子に登録された独自抽出器を返す。
+func lookupExtractor(ext string) (Extractor, bool) {
+	extractorsMu.RLock()
+	defer extractorsMu.RUnlock()
+	fn, ok := extractors[ext]
+	return fn, ok
+}
+
+// ExtractFunctions は拡張子 ext（例: ".go"）の既定の Tree-sitter 設定で src から
+// 関数チャンクを抽出する。nodeType を指定すると関数ノードの種別を上書きできる。
+// Ollama を介さずに抽出処理だけを呼び出すための入口で、ベンチマークなどに用いる。
+// 構文エラーがあっても抽出できたチャンクは返す。
+func ExtractFunctions(src []byte, ext, nodeType string) ([]Chunk, error) {
+	cfg, ok := langConfig[ext]
+	if !ok {
+		return nil, fmt.Errorf("unsupported extension %q", ext)
+	}
+	if nodeType == "" {
+		nodeType = cfg.nodeType
+	}
+	funcs, _, err := extractFunctions(src, cfg.lang, nodeType, cfg.name)
+	return funcs, err
+}
@@ -0,0 +1,188 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExtractFunctions(t *testing.T) {
+	tests := []struct {
+		ext   string
+		src   string
+		names []string
+	}{
+		{".py", "def a():\n    pass\n\ndef b(x):\n    return x\n", []string{"a", "b"}},
+		{".java", "class C {\n  void a() {}\n  int b() { return 1; }\n}\n", []string{"a", "b"}},
+		{".cpp", "int a() { return 0; }\nvoid ns::b(int x) {}\n", []string{"a", "ns::b"}},
+		{".hpp", "inline int a() { return 0; }\n", []string{"a"}},
+		{".h", "static void a(void) {}\n", []string{"a"}},
+		{".go", "package p\n\nfunc A() {}\n\nfunc b() int { return 1 }\n", []string{"A", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ext, func(t *testing.T) {
+			funcs, err := ExtractFunctions([]byte(tt.src), tt.ext, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, fn := range funcs {
+				names = append(names, fn.Name)
+			}
+			if !reflect.DeepEqual(names, tt.names) {
+				t.Errorf("names = %q, want %q", names, tt.names)
+			}
+		})
+	}
+}
+
+func TestExtractFunctionsNameNotFirstIdentifier(t *testing.T) {
+	// 最初の識別子が関数名ではない定義でも、文法ごとの名前フィールドから取り出す
+	tests := []struct {
+		ext, nodeType string
+		src           string
+		want          string
+	}{
+		{".go", "method_declaration", "package p\n\nfunc (s *Server) Handle(w Writer) {}\n", "Handle"},
+		{".py", "", "@cache\ndef compute(value):\n    return value\n", "compute"},
+		{".java", "", "class C {\n  public static <T> List<T> wrap(T item) { return null; }\n}\n", "wrap"},
+		{".cpp", "", "const std::string *Parser::name(int id) const { return nullptr; }\n", "Parser::name"},
+		{".cpp", "", "unsigned long &counter() { static unsigned long n; return n; }\n", "counter"},
+	}
+	for _, tt := range tests {
+		funcs, err := ExtractFunctions([]byte(tt.src), tt.ext, tt.nodeType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(funcs) != 1 || funcs[0].Name != tt.want {
+			t.Errorf("%s %q: got %+v, want one function named %s", tt.ext, tt.src, funcs, tt.want)
+		}
+	}
+}
+
+func TestExtractFunctionsComplexity(t *testing.T) {
+	tests := []struct {
+		ext  string
+		src  string
+		want int
+	}{
+		// case 2 つで +2。default は分岐を増やさない
+		{".java", "class C {\n  int f(int x) {\n    switch (x) {\n      case 1: return 1;\n      case 2: return 2;\n      default: return 0;\n    }\n  }\n}\n", 3},
+		{".cpp", "int f(int x) {\n  switch (x) {\n    case 1: return 1;\n    default: return 0;\n  }\n}\n", 2},
+		{".go", "package p\n\nfunc f(x int) int {\n\tswitch x {\n\tcase 1:\n\t\treturn 1\n\tdefault:\n\t\treturn 0\n\t}\n}\n", 2},
+		{".py", "def f(x):\n    if x:\n        return 1\n    for i in x:\n        pass\n", 3},
+	}
+	for _, tt := range tests {
+		funcs, err := ExtractFunctions([]byte(tt.src), tt.ext, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(funcs) != 1 {
+			t.Fatalf("%s: got %d functions, want 1", tt.ext, len(funcs))
+		}
+		if got := funcs[0].Complexity; got != tt.want {
+			t.Errorf("%s: complexity = %d, want %d", tt.ext, got, tt.want)
+		}
+	}
+}
+
+func TestExtractFunctionsNodeType(t *testing.T) {
+	src := "class C:\n    def m(self):\n        pass\n"
+	funcs, err := ExtractFunctions([]byte(src), ".py", "class_definition")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(funcs) != 1 || funcs[0].Name != "C" {
+		t.Fatalf("funcs = %+v, want the class C", funcs)
+	}
+}
+
+func TestExtractFunctionsUnsupported(t *testing.T) {
+	if _, err := ExtractFunctions([]byte("fn main() {}"), ".rs", ""); err == nil {
+		t.Fatal("ExtractFunctions(.rs) returned no error")
+	}
+}
+
+// largeGoFixture は n 個の関数を持つ Go のソースを返す。
+func largeGoFixture(n int) []byte {
+	var b strings.Builder
+	b.WriteString("package bench\n\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "// F%d is a generated function.\nfunc F%d(x int) int {\n\tif x > %d {\n\t\treturn x - 1\n\t}\n\tfor i := 0; i < x; i++ {\n\t\tx += i\n\t}\n\treturn x\n}\n\n", i, i, i)
+	}
+	return []byte(b.String())
+}
+
+func BenchmarkExtractFunctions(b *testing.B) {
+	src := largeGoFixture(2000)
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		funcs, err := ExtractFunctions(src, ".go", "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(funcs) != 2000 {
+			b.Fatalf("extracted %d functions, want 2000", len(funcs))
+		}
+	}
+}
+
+func TestRegisterExtractorOverridesExtension(t *testing.T) {
+	RegisterExtractor(".py", func(src []byte) ([]Chunk, error) {
+		// ファイル全体を 1 つのクラス単位チャンクとして扱う抽出器
+		return []Chunk{{Name: "WholeClass", Code: append([]byte("custom: "), src...), StartLine: 1, EndLine: 1}}, nil
+	})
+	t.Cleanup(func() { RegisterExtractor(".py", nil) })
+	dir := t.TempDir()
+	writeTree(t, dir, mixedFixture)
+	report := reviewEcho(t, dir, nil)
+	if !strings.Contains(report, "WholeClass") || !strings.Contains(report, "custom: def py_func") {
+		t.Errorf("custom extractor not used for .py:\n%s", report)
+	}
+	if !strings.Contains(report, "GoFunc") {
+		t.Errorf("built-in extractor not used for .go:\n%s", report)
+	}
+}
+
+func TestExtractFunctionsDeeplyNested(t *testing.T) {
+	// 入れ子が極端に深い生成コードでも再帰によるスタック溢れを起こさないこと
+	const depth = 5000
+	src := "package p\n\nfunc Deep() {\n" + strings.Repeat("if x {\n", depth) + "call()\n" + strings.Repeat("}\n", depth) + "}\n\nfunc After() {}\n"
+	funcs, err := ExtractFunctions([]byte(src), ".go", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(funcs) != 2 || funcs[0].Name != "Deep" || funcs[1].Name != "After" {
+		t.Fatalf("got %d functions, want Deep and After", len(funcs))
+	}
+	if got := funcs[0].Complexity; got != depth+1 {
+		t.Errorf("complexity = %d, want %d", got, depth+1)
+	}
+	if !slices.Equal(funcs[0].Callees, []string{"call"}) {
+		t.Errorf("callees = %q, want [call]", funcs[0].Callees)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// splitFindings はモデルのテキスト応答を finding_delimiter で始まる行ごとに
+// 個別の指摘へ分割する。区切り行より前の前置きは指摘に含めない。
+// 区切り行を含まない応答では指摘なしとして nil を返す。
+func splitFindings(raw, delim string) []string {
+	if delim == "" {
+		return nil
+	}
+	var findings []string
+	var cur []string
+	flush := func() {
+		if cur != nil {
+			findings = append(findings, strings.TrimSpace(strings.Join(cur, "\n")))
+		}
+	}
+	for _, line := range strings.Split(raw, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), delim) {
+			flush()
+			cur = []string{line}
+			continue
+		}
+		if cur != nil {
+			cur = append(cur, line)
+		}
+	}
+	flush()
+	return findings
+}
+
+// findingTitle は指摘の見出しを返す。区切り行に続く文字列があればそれを、
+// なければ次の空でない行を見出しとみなす。
+func findingTitle(finding, delim string) string {
+	lines := strings.Split(finding, "\n")
+	title := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[0]), delim))
+	for _, l := range lines[1:] {
+		if title != "" {
+			break
+		}
+		title = strings.TrimSpace(l)
+	}
+	return title
+}
+
+// normalizeTitle は集計のため、見出しの大文字小文字・記号・空白の違いをそろえる。
+func normalizeTitle(title string) string {
+	title = strings.ToLower(strings.Trim(title, " \t:-*#`.\"'"))
+	return strings.Join(strings.Fields(title), " ")
+}
+
+// topIssuesLimit は Top Issues 節に載せる見出しの最大数。
+const topIssuesLimit = 10
+
+// issueTitles は各指摘の見出しを正規化して返す。見出しが空の指摘は除く。
+func issueTitles(findings []string, delim string) []string {
+	var titles []string
+	for _, f := range findings {
+		if t := normalizeTitle(findingTitle(f, delim)); t != "" {
+			titles = append(titles, t)
+		}
+	}
+	return titles
+}
+
+// addIssues は正規化した指摘の見出しを集計に加える。
+func (r *reviewRun) addIssues(titles []string) {
+	for _, t := range titles {
+		if r.issues == nil {
+			r.issues = map[string]int{}
+		}
+		r.issues[t]++
+	}
+}
+
+// topIssuesSection は多く指摘された見出しを件数順の Markdown の表として返す。
+func (r *reviewRun) topIssuesSection() string {
+	if len(r.issues) == 0 {
+		return ""
+	}
+	titles := make([]string, 0, len(r.issues))
+	for t := range r.issues {
+		titles = append(titles, t)
+	}
+	sort.Slice(titles, func(i, j int) bool {
+		if r.issues[titles[i]] != r.issues[titles[j]] {
+			return r.issues[titles[i]] > r.issues[titles[j]]
+		}
+		return titles[i] < titles[j]
+	})
+	if len(titles) > topIssuesLimit {
+		titles = titles[:topIssuesLimit]
+	}
+	var b strings.Builder
+	b.WriteString("# Top Issues\n\n| Issue | Count |\n| --- | --- |\n")
+	for _, t := range titles {
+		fmt.Fprintf(&b, "| %s | %d |\n", strings.ReplaceAll(t, "|", "\\|"), r.issues[t])
+	}
+	b.WriteString("\n")
+	return b.String()
+}
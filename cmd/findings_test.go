@@ -0,0 +1,112 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestSplitFindings(t *testing.T) {
+	raw := "Overall the function is fine.\n\n### FINDING Missing error check\nThe error from Close is ignored.\n\n  ### FINDING\nUnused parameter\nctx is never read.\n"
+	got := splitFindings(raw, "### FINDING")
+	want := []string{
+		"### FINDING Missing error check\nThe error from Close is ignored.",
+		"### FINDING\nUnused parameter\nctx is never read.",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("splitFindings = %q, want %q", got, want)
+	}
+	if titles := issueTitles(got, "### FINDING"); !reflect.DeepEqual(titles, []string{"missing error check", "unused parameter"}) {
+		t.Errorf("issueTitles = %q", titles)
+	}
+	if got := splitFindings("No issues found.", "### FINDING"); got != nil {
+		t.Errorf("response without delimiters split into %q", got)
+	}
+}
+
+func TestReviewCountsDelimitedFindings(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n\n\ndef g():\n    return 2\n"})
+	ollama := newFakeOllama(t, 0)
+	ollama.reply = func(req api.ChatRequest) api.ChatResponse {
+		return api.ChatResponse{Model: req.Model, Done: true, Message: api.Message{Role: "assistant",
+			Content: "### FINDING Magic number\nUse a constant.\n### FINDING Missing docstring\nDocument it.\n"}}
+	}
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "finding_delimiter": "### FINDING"})
+	report := runReview(t, dir)
+	if !strings.Contains(report, "Findings: 4") {
+		t.Errorf("findings not counted in the metadata:\n%s", report)
+	}
+	for _, want := range []string{"| magic number | 2 |", "| missing docstring | 2 |"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Top Issues missing %q:\n%s", want, report)
+		}
+	}
+}
+
+func TestReviewListsCleanFunctions(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def tidy():\n    return 1\n\n\ndef messy():\n    return 2\n"})
+	ollama := newFakeOllama(t, 0)
+	ollama.reply = func(req api.ChatRequest) api.ChatResponse {
+		content := "No issues found."
+		if strings.Contains(req.Messages[len(req.Messages)-1].Content, "messy") {
+			content = "### FINDING Magic number\nUse a constant."
+		}
+		return api.ChatResponse{Model: req.Model, Done: true, Message: api.Message{Role: "assistant", Content: content}}
+	}
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "finding_delimiter": "### FINDING"})
+	report := runReview(t, dir)
+	i := strings.Index(report, "# Clean\n")
+	if i < 0 {
+		t.Fatalf("Clean section missing:\n%s", report)
+	}
+	clean := report[i:]
+	if j := strings.Index(clean[1:], "\n# "); j >= 0 {
+		clean = clean[:j+1]
+	}
+	if !strings.Contains(clean, "tidy (lines 1-2") || strings.Contains(clean, "messy") {
+		t.Errorf("Clean section = %q, want only tidy", clean)
+	}
+}
+
+func TestTopIssuesAggregatesNormalizedTitles(t *testing.T) {
+	const delim = "### FINDING"
+	responses := []string{
+		"### FINDING Missing error check\n...\n### FINDING **Magic number**\n...",
+		"### FINDING missing   error check.\n...",
+		"### FINDING\n`Missing Error Check`\n...\n### FINDING Long function\n...",
+	}
+	var r reviewRun
+	for _, raw := range responses {
+		r.addIssues(issueTitles(splitFindings(raw, delim), delim))
+	}
+	want := "# Top Issues\n\n| Issue | Count |\n| --- | --- |\n" +
+		"| missing error check | 3 |\n| long function | 1 |\n| magic number | 1 |\n\n"
+	if got := r.topIssuesSection(); got != want {
+		t.Errorf("topIssuesSection =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,301 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/spf13/viper"
+)
+
+func TestMain(m *testing.M) {
+	// レビューの進捗ログはテスト結果の妨げになるため捨てる
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// resetConfig は viper の設定を settings だけにし、テスト終了時に元へ戻す。
+func resetConfig(t *testing.T, settings map[string]any) {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	for k, v := range settings {
+		viper.Set(k, v)
+	}
+}
+
+// writeTree は dir 配下に files（相対パス → 内容）を書き出す。
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// echoGuideline は echo モデルでコードだけを返させるガイドライン。
+const echoGuideline = "{{.code}}"
+
+// echoConfig は echo モデルでコードだけを返させる設定に settings を重ねて
+// 適用する。
+func echoConfig(t *testing.T, settings map[string]any) {
+	t.Helper()
+	templateConfig(t, echoGuideline, settings)
+}
+
+// templateConfig は echo モデルで tmpl を描画した結果を返させる設定に
+// settings を重ねて適用する。
+func templateConfig(t *testing.T, tmpl string, settings map[string]any) {
+	t.Helper()
+	guideline := filepath.Join(t.TempDir(), "guideline.tmpl")
+	if err := os.WriteFile(guideline, []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	base := map[string]any{"model": echoModel, "guideline": guideline, "deterministic": true}
+	for k, v := range settings {
+		base[k] = v
+	}
+	resetConfig(t, base)
+}
+
+// runReview は現在の設定で target をレビューし、レポートの内容を返す。
+func runReview(t *testing.T, target string) string {
+	t.Helper()
+	return runReviewTo(t, target, filepath.Join(t.TempDir(), "report.md"))
+}
+
+// runReviewTo は現在の設定で target をレビューして out へ書き出し、その内容を返す。
+func runReviewTo(t *testing.T, target, out string) string {
+	t.Helper()
+	if err := Review(context.Background(), target, out); err != nil {
+		t.Fatalf("Review: %v", err)
+	}
+	report, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(report)
+}
+
+// reviewEcho は echo モデルで target をレビューし、レポートの内容を返す。
+func reviewEcho(t *testing.T, target string, settings map[string]any) string {
+	t.Helper()
+	echoConfig(t, settings)
+	return runReview(t, target)
+}
+
+// fakeOllama は /api/chat にユーザ発話をそのまま返す Ollama の代役。
+// 同時に処理した要求数の最大値を記録する。
+type fakeOllama struct {
+	*httptest.Server
+	delay time.Duration // 各応答を返すまでの待ち時間
+
+	mu       sync.Mutex
+	inFlight int
+	peak     int      // 同時に処理した要求数の最大値
+	models   []string // 受け付けたチャット要求のモデル名
+	requests []api.ChatRequest
+	headers  []http.Header // 受け付けたチャット要求のヘッダ
+
+	// chatError が空でなければ、チャット要求をすべてこのエラーで失敗させる。
+	chatError string
+	// reply が設定されていれば、ユーザ発話を返す代わりにその戻り値を応答とする。
+	reply func(api.ChatRequest) api.ChatResponse
+
+	// sizes はインストール済みとして /api/tags に載せるモデルと、/api/show で
+	// 返す parameter_size。ないモデルは /api/show で 404 になる。
+	sizes map[string]string
+
+	prompts []string // 受け付けた /api/generate のプロンプト
+
+	pullFailures int // 失敗させる /api/pull の回数。以降の要求は成功させる
+	pulls        int // 受け付けた /api/pull の回数
+}
+
+// newFakeOllama は fakeOllama を起動し、テスト終了時に停止する。
+func newFakeOllama(t *testing.T, delay time.Duration) *fakeOllama {
+	t.Helper()
+	f := &fakeOllama{delay: delay, sizes: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/chat", f.chat)
+	mux.HandleFunc("POST /api/show", f.show)
+	mux.HandleFunc("GET /api/tags", f.tags)
+	mux.HandleFunc("POST /api/pull", f.pull)
+	mux.HandleFunc("POST /api/generate", f.generate)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeOllama) chat(w http.ResponseWriter, r *http.Request) {
+	var req api.ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.inFlight++
+	f.peak = max(f.peak, f.inFlight)
+	f.models = append(f.models, req.Model)
+	f.requests = append(f.requests, req)
+	f.headers = append(f.headers, r.Header.Clone())
+	f.mu.Unlock()
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	f.inFlight--
+	f.mu.Unlock()
+	if f.chatError != "" {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": f.chatError})
+		return
+	}
+	resp := api.ChatResponse{
+		Model:   req.Model,
+		Message: api.Message{Role: "assistant", Content: req.Messages[len(req.Messages)-1].Content},
+		Done:    true,
+	}
+	if f.reply != nil {
+		resp = f.reply(req)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// generate はプロンプトを行ごとに分けてストリームで返す。
+func (f *fakeOllama) generate(w http.ResponseWriter, r *http.Request) {
+	var req api.GenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.prompts = append(f.prompts, req.Prompt)
+	f.mu.Unlock()
+	enc := json.NewEncoder(w)
+	for _, line := range strings.SplitAfter(req.Prompt, "\n") {
+		enc.Encode(api.GenerateResponse{Model: req.Model, Response: line})
+	}
+	enc.Encode(api.GenerateResponse{Model: req.Model, Done: true})
+}
+
+func (f *fakeOllama) show(w http.ResponseWriter, r *http.Request) {
+	var req api.ShowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	size, ok := f.sizes[req.Model]
+	if !ok {
+		http.Error(w, `{"error":"model not found"}`, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(api.ShowResponse{Details: api.ModelDetails{ParameterSize: size}})
+}
+
+func (f *fakeOllama) tags(w http.ResponseWriter, r *http.Request) {
+	var list api.ListResponse
+	f.mu.Lock()
+	for m := range f.sizes {
+		list.Models = append(list.Models, api.ListModelResponse{Name: m})
+	}
+	f.mu.Unlock()
+	json.NewEncoder(w).Encode(list)
+}
+
+// pull は pullFailures 回までダウンロード途中の失敗を返し、以降はモデルを
+// インストール済みにする。
+func (f *fakeOllama) pull(w http.ResponseWriter, r *http.Request) {
+	var req api.PullRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pulls++
+	enc := json.NewEncoder(w)
+	enc.Encode(api.ProgressResponse{Status: "pulling manifest"})
+	if f.pulls <= f.pullFailures {
+		enc.Encode(map[string]string{"error": "connection reset by peer"})
+		return
+	}
+	model := req.Model
+	if model == "" {
+		model = req.Name
+	}
+	f.sizes[model] = "7B"
+	enc.Encode(api.ProgressResponse{Status: "success"})
+}
+
+// chatModels は受け付けたチャット要求のモデル名を返す。
+func (f *fakeOllama) chatModels() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.models)
+}
+
+// chatRequests は受け付けたチャット要求を返す。
+func (f *fakeOllama) chatRequests() []api.ChatRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.requests)
+}
+
+// generatePrompts は受け付けた /api/generate のプロンプトを返す。
+func (f *fakeOllama) generatePrompts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.prompts)
+}
+
+// chatHeaders は受け付けたチャット要求のヘッダを返す。
+func (f *fakeOllama) chatHeaders() []http.Header {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.headers)
+}
+
+// peakRequests は同時に処理した要求数の最大値を返し、記録を消去する。
+func (f *fakeOllama) peakRequests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	peak := f.peak
+	f.peak = 0
+	return peak
+}
@@ -0,0 +1,178 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreRule は .reviewignore の 1 行を正規表現に変換したもの。
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool // "!" で始まる再包含ルール
+	dirOnly bool // "/" で終わるディレクトリ専用ルール
+}
+
+// ignoreMatcher は gitignore 形式のルール群。後に書かれたルールほど優先される。
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+// loadIgnoreFile は gitignore 形式のファイルを読み込む。ファイルが存在しない
+// 場合は nil を返し、何も除外しない。
+func loadIgnoreFile(path string) (*ignoreMatcher, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &ignoreMatcher{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseIgnoreRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	return m, sc.Err()
+}
+
+// parseIgnoreRule は gitignore の 1 パターンを正規表現に変換する。
+// "/" を含むパターンはルートからの相対パスに、含まないパターンは任意の階層の
+// 名前に一致する。"*"、"?"、"**" をサポートする。
+func parseIgnoreRule(pattern string) (ignoreRule, error) {
+	var rule ignoreRule
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "/**"):
+			b.WriteString("(?:/.*)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return rule, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	rule.re = re
+	return rule, nil
+}
+
+// Match は rel（ルートからの "/" 区切り相対パス）が除外対象かを判定する。
+func (m *ignoreMatcher) Match(rel string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	ignored := false
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(rel) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// loadGitmodules は .gitmodules に記載されたサブモジュールのパスを、
+// リポジトリからの相対パス（スラッシュ区切り）の集合として返す。
+// ファイルが存在しない場合は空の集合を返す。
+func loadGitmodules(path string) (map[string]struct{}, error) {
+	paths := map[string]struct{}{}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return paths, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		key, val, ok := strings.Cut(sc.Text(), "=")
+		if ok && strings.TrimSpace(key) == "path" {
+			paths[filepath.ToSlash(filepath.Clean(strings.TrimSpace(val)))] = struct{}{}
+		}
+	}
+	return paths, sc.Err()
+}
+
+// isSubmoduleDir は dir が git サブモジュールのチェックアウトかを判定する。
+// .gitmodules に記載されているか、.git がディレクトリではなく gitlink の
+// ファイルである場合にサブモジュールとみなす。
+func isSubmoduleDir(root, dir string, submodules map[string]struct{}) bool {
+	if rel, err := filepath.Rel(root, dir); err == nil {
+		if _, ok := submodules[filepath.ToSlash(rel)]; ok {
+			return true
+		}
+	}
+	info, err := os.Lstat(filepath.Join(dir, ".git"))
+	return err == nil && info.Mode().IsRegular()
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+var initForce bool
+
+// initCmd は設定ファイルとガイドラインの雛形を生成するサブコマンド
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "設定ファイルとガイドラインの雛形を生成する",
+	Long: `カレントディレクトリに既定値入りの config.yaml と
+ガイドラインテンプレート guideline.tmpl を生成します。
+既存ファイルは --force を指定しない限り上書きしません。`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cobra.CheckErr(scaffold(".", initForce))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+
+	// 既存ファイルの上書きを許可するフラグ
+	initCmd.Flags().BoolVar(&initForce, "force", false, "Overwrite existing files")
+}
+
+// scaffoldConfig は init で生成する config.yaml の内容。
+const scaffoldConfig = `# ollama_review の設定ファイル
+# 使用するモデル名
+model: codellama:13b
+# ガイドラインテンプレート（{{.lang}} と {{.code}} が埋め込まれる）
+guideline: guideline.tmpl
+# 探索から除外するディレクトリ名（vendor や node_modules は既定で除外）
+exclude:
+  - "tests"
+# レポートの出力先（"-" で標準出力）
+output: code_review.md
+# Ollama サーバの URL（${OLLAMA_HOST} のように環境変数も参照できる）
+ollamaHost: http://localhost:11434
+
+# --- 以下は任意設定 ---
+# 再現性のための乱数シード
+# seed: 42
+# 応答の最大トークン数
+# max_output_tokens: 1024
+# レビュー本文の言語
+# review_language: Japanese
+# 複雑度がこの値未満の関数はレビューしない
+# min_complexity: 3
+`
+
+// scaffoldGuideline は init で生成する guideline.tmpl の内容。
+const scaffoldGuideline = `You are a strict code reviewer. Follow ALL the rules below.
+
+1. Readability and naming
+2. Maintainability (duplication, separation of concerns)
+3. Safety and stability (error handling, resource management, input validation)
+4. Performance (unnecessary loops, network/file I/O efficiency)
+5. Security (potential vulnerabilities, hard-coded secrets)
+
+The code to review:
+` + "```{{.lang}}\n{{.code}}\n```" + `
+
+Output in Markdown with sections:
+
+1. Summary
+2. Violations
+3. Suggestions
+4. Other notes
+`
+
+// scaffold は dir に config.yaml と guideline.tmpl を書き出す。force が false の
+// 場合、既存ファイルがあれば何も書かずにエラーを返す。
+func scaffold(dir string, force bool) error {
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"config.yaml", scaffoldConfig},
+		{"guideline.tmpl", scaffoldGuideline},
+	}
+	if !force {
+		for _, f := range files {
+			path := filepath.Join(dir, f.name)
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists (use --force to overwrite)", path)
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, []byte(f.content), 0644); err != nil {
+			return fmt.Errorf("write %s: %w", path, err)
+		}
+		log.Printf("Created %s", path)
+	}
+	return nil
+}
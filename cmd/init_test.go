@@ -0,0 +1,77 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestScaffoldWritesConfigAndGuideline(t *testing.T) {
+	dir := t.TempDir()
+	if err := scaffold(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	resetConfig(t, nil)
+	viper.SetConfigFile(filepath.Join(dir, "config.yaml"))
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatalf("generated config.yaml does not parse: %v", err)
+	}
+	for _, key := range []string{"model", "guideline", "exclude", "output", "ollamahost"} {
+		if !viper.IsSet(key) {
+			t.Errorf("generated config.yaml lacks %s", key)
+		}
+	}
+	if got := viper.GetString("guideline"); got != "guideline.tmpl" {
+		t.Errorf("guideline = %q, want guideline.tmpl", got)
+	}
+	viper.Set("guideline", filepath.Join(dir, "guideline.tmpl"))
+	tmpl, err := loadGuideline("guideline", nil)
+	if err != nil {
+		t.Fatalf("generated guideline.tmpl does not parse: %v", err)
+	}
+	prompt, err := buildPrompt(tmpl, "go", Chunk{Name: "f", Code: []byte("func f() {}")})
+	if err != nil || !strings.Contains(prompt, "```go\nfunc f() {}\n```") {
+		t.Errorf("generated guideline renders %q (err %v)", prompt, err)
+	}
+}
+
+func TestScaffoldRefusesOverwriteWithoutForce(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"guideline.tmpl": "custom"})
+	if err := scaffold(dir, false); err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("scaffold = %v, want a refusal to overwrite", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "config.yaml")); err == nil {
+		t.Error("config.yaml written although guideline.tmpl already existed")
+	}
+	if err := scaffold(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "guideline.tmpl")); string(got) != scaffoldGuideline {
+		t.Errorf("guideline.tmpl not overwritten with --force: %q", got)
+	}
+}
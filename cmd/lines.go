@@ -0,0 +1,84 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// lineRange は --source file.go:40:90 形式で指定された 1 始まりの行範囲。
+type lineRange struct {
+	start int
+	end   int
+}
+
+// sourceSpecPattern は "path:start:end" 形式の末尾を表す。
+var sourceSpecPattern = regexp.MustCompile(`^(.+):(\d+):(\d+)$`)
+
+// parseSourceSpec は "path:start:end" 形式の指定をパスと行範囲に分解する。
+// 指定文字列そのものが既存パスである場合や形式に合わない場合は行範囲なしで返す。
+func parseSourceSpec(spec string) (string, *lineRange, error) {
+	if _, err := os.Stat(spec); err == nil {
+		return spec, nil, nil
+	}
+	m := sourceSpecPattern.FindStringSubmatch(spec)
+	if m == nil {
+		return spec, nil, nil
+	}
+	start, _ := strconv.Atoi(m[2])
+	end, _ := strconv.Atoi(m[3])
+	if start < 1 || end < start {
+		return "", nil, fmt.Errorf("invalid line range %d:%d", start, end)
+	}
+	return m[1], &lineRange{start: start, end: end}, nil
+}
+
+// apply は行範囲に重なる関数のみを残す。重なる関数がない場合は範囲の行を
+// そのまま 1 つのチャンクとして返す。範囲がファイルの行数を超える場合はエラー。
+func (r *lineRange) apply(src []byte, funcs []Chunk) ([]Chunk, error) {
+	lines := bytes.SplitAfter(src, []byte("\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if r.end > len(lines) {
+		return nil, fmt.Errorf("line range %d:%d exceeds %d lines", r.start, r.end, len(lines))
+	}
+	var kept []Chunk
+	for _, fn := range funcs {
+		if fn.StartLine <= r.end && fn.EndLine >= r.start {
+			kept = append(kept, fn)
+		}
+	}
+	if len(kept) > 0 {
+		return kept, nil
+	}
+	return []Chunk{{
+		Name:      fmt.Sprintf("lines %d-%d", r.start, r.end),
+		Code:      bytes.Join(lines[r.start-1:r.end], nil),
+		StartLine: r.start,
+		EndLine:   r.end,
+	}}, nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// fenceLanguages はコードブロックの言語タグを langConfig の言語キーへ対応づける。
+var fenceLanguages = map[string]string{
+	"go":     "go",
+	"golang": "go",
+	"py":     "py",
+	"python": "py",
+	"java":   "java",
+	"cpp":    "cpp",
+	"c++":    "cpp",
+	"cc":     "cpp",
+	"hpp":    "cpp",
+	"h":      "cpp",
+}
+
+// extractFencedBlocks は Markdown 中の言語タグ付きフェンスドコードブロックを
+// 1 ブロック 1 チャンクとして抽出する。対応していない言語のブロックは無視する。
+func extractFencedBlocks(src []byte) ([]Chunk, error) {
+	var blocks []Chunk
+	var (
+		fence string // 開いているフェンス（空なら外側）
+		lang  string
+		body  []string
+		start int
+	)
+	for i, line := range strings.Split(string(src), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if fence == "" {
+			for _, f := range []string{"```", "~~~"} {
+				if strings.HasPrefix(trimmed, f) {
+					fence = f
+					info := strings.Fields(strings.TrimLeft(trimmed, f[:1]))
+					lang = ""
+					if len(info) > 0 {
+						lang = fenceLanguages[strings.ToLower(info[0])]
+					}
+					body, start = nil, i+2
+					break
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			if lang != "" && len(body) > 0 {
+				blocks = append(blocks, Chunk{
+					Name:      fmt.Sprintf("%s code block", lang),
+					Code:      []byte(strings.Join(body, "\n")),
+					StartLine: start,
+					EndLine:   i,
+					Lang:      lang,
+				})
+			}
+			fence = ""
+			continue
+		}
+		body = append(body, line)
+	}
+	return blocks, nil
+}
@@ -0,0 +1,287 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hunkHeaderPattern は unified diff のハンクヘッダ "@@ -a,b +c,d @@" を表す。
+var hunkHeaderPattern = regexp.MustCompile(`^@@ -\d+(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// parsePatch は unified diff を読み、変更後のファイルパスごとに追加・変更された
+// 行範囲を返す。行を削除しただけの箇所は、変更後のファイルで削除位置の前後に
+// ある 2 行を変更行として扱う。削除されたファイルは含めない。パスの a/ b/
+// 接頭辞は取り除く。
+func parsePatch(r io.Reader) (map[string][]lineRange, error) {
+	changed := map[string][]lineRange{}
+	// mark は start から end の行を変更行として記録し、直前の範囲と重なるか
+	// 隣接する場合はまとめる
+	mark := func(file string, start, end int) {
+		if file == "" {
+			return
+		}
+		if start < 1 {
+			start = 1
+		}
+		rs := changed[file]
+		if n := len(rs); n > 0 && rs[n-1].end >= start-1 {
+			if end > rs[n-1].end {
+				rs[n-1].end = end
+			}
+		} else {
+			rs = append(rs, lineRange{start: start, end: end})
+		}
+		changed[file] = rs
+	}
+	var file string
+	line := 0                // 変更後のファイルでの次の行番号
+	oldLeft, newLeft := 0, 0 // ハンク内で残っている変更前・変更後の行数
+	count := func(s string) int {
+		if s == "" {
+			return 1
+		}
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 16*1024*1024)
+	for sc.Scan() {
+		text := sc.Text()
+		if oldLeft > 0 || newLeft > 0 {
+			// ハンク本体。"+++" や "---" で始まる行も内容として扱う
+			switch {
+			case strings.HasPrefix(text, "+"):
+				mark(file, line, line)
+				line++
+				newLeft--
+			case strings.HasPrefix(text, "-"):
+				// 削除された行は変更後のファイルに残らないため、前後の行で表す
+				mark(file, line-1, line)
+				oldLeft--
+			case strings.HasPrefix(text, "\\"):
+				// "\ No newline at end of file"
+			default:
+				line++
+				oldLeft--
+				newLeft--
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(text, "+++ "):
+			file = strings.TrimSpace(strings.TrimPrefix(text, "+++ "))
+			if i := strings.IndexByte(file, '\t'); i >= 0 {
+				file = file[:i] // タイムスタンプ付きの形式
+			}
+			if file == "/dev/null" {
+				file = ""
+			} else {
+				file = strings.TrimPrefix(file, "b/")
+			}
+		case strings.HasPrefix(text, "@@"):
+			m := hunkHeaderPattern.FindStringSubmatch(text)
+			if m == nil {
+				return nil, fmt.Errorf("invalid hunk header %q", text)
+			}
+			line, _ = strconv.Atoi(m[2])
+			oldLeft, newLeft = count(m[1]), count(m[3])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// loadPatch は path の diff ファイルを読み込んで parsePatch の結果を返す。
+func loadPatch(path string) (map[string][]lineRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("read patch: %w", err)
+	}
+	defer f.Close()
+	changed, err := parsePatch(f)
+	if err != nil {
+		return nil, fmt.Errorf("parse patch %s: %w", path, err)
+	}
+	return changed, nil
+}
+
+// resolvePatch は diff に含まれるファイルのうち root 配下に存在するものを
+// パス順に返し、あわせて各パスの変更行範囲を返す。
+func resolvePatch(root string, changed map[string][]lineRange) ([]string, map[string][]lineRange) {
+	var paths []string
+	byPath := map[string][]lineRange{}
+	for name, ranges := range changed {
+		p := name
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(root, filepath.FromSlash(name))
+		}
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			paths = append(paths, p)
+			byPath[p] = ranges
+		}
+	}
+	sort.Strings(paths)
+	return paths, byPath
+}
+
+// patchPaths は diff ファイル patch を読み込み、変更行範囲を r.changed に
+// 設定したうえで、探索の除外設定に当たらない変更ファイルを返す。
+func (r *reviewRun) patchPaths(patch string, filter *walkFilter) ([]string, error) {
+	changed, err := loadPatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	kept := r.changedPaths(changed, filter)
+	log.Printf("Patch %s: %d changed files to review", patch, len(kept))
+	return kept, nil
+}
+
+// diffPaths は base との差分を git から取得し、patchPaths と同様に変更行範囲を
+// r.changed に設定して変更ファイルを返す。base が diffAutoBase の場合は
+// リモートの既定ブランチを基準にする。
+func (r *reviewRun) diffPaths(base string, filter *walkFilter) ([]string, error) {
+	if base == diffAutoBase {
+		detected, err := defaultBaseBranch(r.root)
+		if err != nil {
+			return nil, err
+		}
+		base = detected
+	}
+	out, err := gitDiff(r.root, base)
+	if err != nil {
+		return nil, fmt.Errorf("git diff %s: %w", base, err)
+	}
+	changed, err := parsePatch(strings.NewReader(out))
+	if err != nil {
+		return nil, fmt.Errorf("parse diff against %s: %w", base, err)
+	}
+	kept := r.changedPaths(changed, filter)
+	log.Printf("Diff against %s: %d changed files to review", base, len(kept))
+	return kept, nil
+}
+
+// changedPaths は変更行範囲を r.changed に設定し、探索の除外設定に当たらない
+// 変更ファイルを返す。
+func (r *reviewRun) changedPaths(changed map[string][]lineRange, filter *walkFilter) []string {
+	paths, byPath := resolvePatch(r.root, changed)
+	kept := paths[:0]
+	for _, p := range paths {
+		if !filter.skipChanged(p) {
+			kept = append(kept, p)
+		}
+	}
+	r.changed = byPath
+	return kept
+}
+
+// skipChanged は --patch / --diff で挙がった変更ファイル path を、探索時と
+// 同じ規則で除外すべきかを判定する。探索では除外ディレクトリやサブモジュール、
+// max_depth より深いディレクトリの中へは入らないため、root から path までの
+// 各ディレクトリにも同じ判定を適用する。
+func (f *walkFilter) skipChanged(path string) bool {
+	rel, err := filepath.Rel(f.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return true
+	}
+	dir := f.root
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for _, name := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, name)
+		if f.skipDir(dir, name) {
+			return true
+		}
+	}
+	return f.skipFile(path)
+}
+
+// diffAutoBase は --diff を引数なしで指定したときの値で、基準ブランチを
+// 自動で判定することを表す。
+const diffAutoBase = "auto"
+
+// gitDiff は base とのマージベースから作業ツリーまでの差分を、dir からの
+// 相対パスの unified diff として返す。テストなどから差し替えられるよう
+// 変数として定義している。
+var gitDiff = func(dir, base string) (string, error) {
+	out, err := exec.Command("git", "-C", dir, "diff", "--relative", "--no-color",
+		"--no-ext-diff", "--merge-base", base).Output()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// gitRemoteHead は origin/HEAD が指すブランチ名（"origin/main" など）を返す。
+// gitDiff と同じくテストなどから差し替えられるよう変数として定義している。
+var gitRemoteHead = func(dir string) (string, error) {
+	out, err := exec.Command("git", "-C", dir, "symbolic-ref", "--quiet", "--short",
+		"refs/remotes/origin/HEAD").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitRefExists は ref が解決できるかを返す。
+var gitRefExists = func(dir, ref string) bool {
+	return exec.Command("git", "-C", dir, "rev-parse", "--verify", "--quiet", ref+"^{commit}").Run() == nil
+}
+
+// defaultBaseBranch は差分の基準にするブランチを判定する。origin/HEAD が
+// 設定されていればそれを使い、なければ main、master の順に存在するものを使う。
+func defaultBaseBranch(dir string) (string, error) {
+	if head, err := gitRemoteHead(dir); err == nil && head != "" {
+		return head, nil
+	}
+	for _, b := range []string{"main", "master"} {
+		if gitRefExists(dir, b) {
+			return b, nil
+		}
+	}
+	return "", fmt.Errorf("cannot determine the base branch in %s: set --diff <branch>", dir)
+}
+
+// overlapping は ranges のいずれかの行範囲に重なる関数だけを残す。
+func overlapping(funcs []Chunk, ranges []lineRange) []Chunk {
+	var kept []Chunk
+	for _, fn := range funcs {
+		for _, r := range ranges {
+			if fn.StartLine <= r.end && fn.EndLine >= r.start {
+				kept = append(kept, fn)
+				break
+			}
+		}
+	}
+	return kept
+}
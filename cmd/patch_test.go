@@ -0,0 +1,156 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePatch(t *testing.T) {
+	diff := `diff --git a/a.py b/a.py
+--- a/a.py
++++ b/a.py
+@@ -1,2 +1,4 @@
+ def f():
++    y = 2
++    --- not a header
+     return 1
+@@ -10,3 +11,2 @@ def g():
+ def g():
+-    x = 1
+     return 2
+diff --git a/gone.py b/gone.py
+--- a/gone.py
++++ /dev/null
+@@ -1 +0,0 @@
+-def gone(): pass
+`
+	changed, err := parsePatch(strings.NewReader(diff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]lineRange{"a.py": {{start: 2, end: 3}, {start: 11, end: 12}}}
+	if !reflect.DeepEqual(changed, want) {
+		t.Errorf("parsePatch = %+v, want %+v", changed, want)
+	}
+}
+
+func TestParsePatchDeletionSelectsFunction(t *testing.T) {
+	// 削除だけのハンクでも、削除箇所を含む関数が選ばれること
+	diff := "--- a/a.py\n+++ b/a.py\n@@ -4,4 +4,3 @@\n def g():\n-    x = 1\n     y = 2\n     return y\n"
+	changed, err := parsePatch(strings.NewReader(diff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	funcs := []Chunk{{Name: "f", StartLine: 1, EndLine: 2}, {Name: "g", StartLine: 4, EndLine: 6}}
+	kept := overlapping(funcs, changed["a.py"])
+	if len(kept) != 1 || kept[0].Name != "g" {
+		t.Errorf("overlapping = %+v, want only g", kept)
+	}
+}
+
+func TestChangedPathsAppliesWalkRules(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"src/a.py":        "def a(): pass\n",
+		"vendor/lib/b.py": "def b(): pass\n",
+		"excluded/c.py":   "def c(): pass\n",
+		"deep/x/y/d.py":   "def d(): pass\n",
+		"sub/e.py":        "def e(): pass\n",
+		"report.md":       "# report\n",
+		".gitmodules":     "[submodule \"sub\"]\n\tpath = sub\n",
+		"src/f.py":        "def f(): pass\n",
+	})
+	resetConfig(t, map[string]any{"exclude": []string{"excluded"}, "max_depth": 2})
+	filter, err := newWalkFilter(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter.output = filepath.Join(root, "report.md")
+	changed := map[string][]lineRange{}
+	for _, name := range []string{"src/a.py", "vendor/lib/b.py", "excluded/c.py", "deep/x/y/d.py", "sub/e.py", "report.md", "src/f.py"} {
+		changed[name] = []lineRange{{start: 1, end: 1}}
+	}
+	r := &reviewRun{root: root}
+	got := r.changedPaths(changed, filter)
+	want := []string{filepath.Join(root, "src/a.py"), filepath.Join(root, "src/f.py")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changedPaths = %q, want %q", got, want)
+	}
+}
+
+func TestReviewPatchOnlyChangedFunctions(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"a.py":        "def untouched():\n    return 1\n\ndef edited():\n    return 2\n",
+		"vendor/v.py": "def vendored():\n    return 3\n",
+	})
+	patch := filepath.Join(t.TempDir(), "change.diff")
+	diff := "--- a/a.py\n+++ b/a.py\n@@ -5 +5 @@\n-    return 0\n+    return 2\n--- a/vendor/v.py\n+++ b/vendor/v.py\n@@ -2 +2 @@\n-    return 0\n+    return 3\n"
+	if err := os.WriteFile(patch, []byte(diff), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report := reviewEcho(t, root, map[string]any{"patch": patch})
+	if !strings.Contains(report, "edited") || strings.Contains(report, "untouched") {
+		t.Errorf("patch review did not select only the edited function:\n%s", report)
+	}
+	if strings.Contains(report, "vendored") {
+		t.Errorf("patch review included a vendored file:\n%s", report)
+	}
+}
+
+func TestReviewDiffAgainstDetectedBaseBranch(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"a.py": "def untouched():\n    return 1\n\ndef edited():\n    return 2\n",
+	})
+	origDiff, origHead, origExists := gitDiff, gitRemoteHead, gitRefExists
+	t.Cleanup(func() { gitDiff, gitRemoteHead, gitRefExists = origDiff, origHead, origExists })
+	var bases []string
+	gitDiff = func(dir, base string) (string, error) {
+		bases = append(bases, base)
+		return "--- a/a.py\n+++ b/a.py\n@@ -5 +5 @@\n-    return 0\n+    return 2\n", nil
+	}
+
+	gitRemoteHead = func(string) (string, error) { return "origin/develop", nil }
+	report := reviewEcho(t, root, map[string]any{"diff": diffAutoBase})
+	if !strings.Contains(report, "edited") || strings.Contains(report, "untouched") {
+		t.Errorf("diff review did not select only the edited function:\n%s", report)
+	}
+
+	// origin/HEAD が無ければ main、次いで master を基準にする。
+	gitRemoteHead = func(string) (string, error) { return "", errors.New("no origin/HEAD") }
+	gitRefExists = func(_, ref string) bool { return ref == "master" }
+	reviewEcho(t, root, map[string]any{"diff": diffAutoBase})
+
+	// 明示したブランチはそのまま使う。
+	reviewEcho(t, root, map[string]any{"diff": "release"})
+
+	if want := []string{"origin/develop", "master", "release"}; !reflect.DeepEqual(bases, want) {
+		t.Errorf("diff bases = %v, want %v", bases, want)
+	}
+}
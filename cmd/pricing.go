@@ -0,0 +1,94 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spf13/viper"
+)
+
+// tokenUsage は 1 モデルぶんの消費トークン数。
+type tokenUsage struct {
+	prompt int
+	output int
+}
+
+// pricing は pricing 設定の 1k トークンあたりの単価。
+type pricing struct {
+	InputPer1K  float64 `mapstructure:"input_per_1k"`
+	OutputPer1K float64 `mapstructure:"output_per_1k"`
+}
+
+// cost は u のトークン数に単価を掛けた見積もり費用を返す。
+func (p pricing) cost(u tokenUsage) float64 {
+	return float64(u.prompt)/1000*p.InputPer1K + float64(u.output)/1000*p.OutputPer1K
+}
+
+// addUsage はモデル model で得た結果 res のトークン数を集計に加える。
+// compare_models でまとめた結果は各モデルの結果をそれぞれ計上する。
+func (r *reviewRun) addUsage(model string, res reviewResult) {
+	for m, mr := range res.byModel {
+		r.addUsage(m, mr)
+	}
+	if res.PromptTokens == 0 && res.OutputTokens == 0 {
+		// トークン数のない結果は計上しない
+		return
+	}
+	if r.usage == nil {
+		r.usage = map[string]*tokenUsage{}
+	}
+	u, ok := r.usage[model]
+	if !ok {
+		u = &tokenUsage{}
+		r.usage[model] = u
+	}
+	u.prompt += res.PromptTokens
+	u.output += res.OutputTokens
+}
+
+// costLines は pricing が設定されていれば、モデルごとの見積もり費用を
+// メタデータの行として返す。
+func (r *reviewRun) costLines() []string {
+	if !viper.IsSet("pricing") || len(r.usage) == 0 {
+		return nil
+	}
+	var p pricing
+	if err := viper.UnmarshalKey("pricing", &p); err != nil {
+		return []string{fmt.Sprintf("Estimated cost: unavailable (parse pricing: %v)", err)}
+	}
+	models := make([]string, 0, len(r.usage))
+	for m := range r.usage {
+		models = append(models, m)
+	}
+	sort.Strings(models)
+	var lines []string
+	total := 0.0
+	for _, m := range models {
+		u := *r.usage[m]
+		c := p.cost(u)
+		total += c
+		lines = append(lines, fmt.Sprintf("Estimated cost (%s): %.4f (input %d tokens, output %d tokens)", m, c, u.prompt, u.output))
+	}
+	return append(lines, fmt.Sprintf("Estimated cost (total): %.4f", total))
+}
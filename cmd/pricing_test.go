@@ -0,0 +1,62 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestPricingCost(t *testing.T) {
+	p := pricing{InputPer1K: 0.5, OutputPer1K: 1.5}
+	// 2000 * 0.5 / 1000 + 400 * 1.5 / 1000
+	if got := p.cost(tokenUsage{prompt: 2000, output: 400}); math.Abs(got-1.6) > 1e-9 {
+		t.Errorf("cost = %v, want 1.6", got)
+	}
+}
+
+func TestReviewReportsEstimatedCost(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n\n\ndef g():\n    return 2\n"})
+	ollama := newFakeOllama(t, 0)
+	ollama.reply = func(req api.ChatRequest) api.ChatResponse {
+		return api.ChatResponse{
+			Model:   req.Model,
+			Message: api.Message{Role: "assistant", Content: "ok"},
+			Done:    true,
+			Metrics: api.Metrics{PromptEvalCount: 1000, EvalCount: 200},
+		}
+	}
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "pricing": map[string]any{"input_per_1k": 0.5, "output_per_1k": 1.5}})
+	report := runReview(t, dir)
+	for _, want := range []string{
+		"Estimated cost (fake): 1.6000 (input 2000 tokens, output 400 tokens)",
+		"Estimated cost (total): 1.6000",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report missing %q:\n%s", want, report)
+		}
+	}
+}
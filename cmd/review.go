@@ -24,17 +24,28 @@ package cmd
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
-	"net/http"
-	"net/url"
+	"math"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/briandowns/spinner"
 	"github.com/ollama/ollama/api"
@@ -50,32 +61,83 @@ import (
 // を依頼するためのユーティリティ関数群を提供する。
 
 // langConfig では拡張子ごとに Tree-sitter の設定を定義する。
-// lang は解析に用いる言語定義、nodeType は関数ノードの種類を表す。
-// 対応言語を追加する際はここへ設定を追記するだけでよい。
+// lang は解析に用いる言語定義、nodeType は関数ノードの種類、name は関数名の
+// 取り出し方を表す。対応言語を追加する際はここへ設定を追記するだけでよい。
 var langConfig = map[string]struct {
-	lang      *sitter.Language
-	nodeType  string
-	nameField string
+	lang     *sitter.Language
+	nodeType string
+	name     nameFunc
 }{
-	".py":   {python.GetLanguage(), "function_definition", "name"},
-	".java": {java.GetLanguage(), "method_declaration", "name"},
-	".cpp":  {cpp.GetLanguage(), "function_definition", "declarator"},
-	".hpp":  {cpp.GetLanguage(), "function_definition", "declarator"},
-	".h":    {cpp.GetLanguage(), "function_definition", "declarator"},
-	".go":   {golang.GetLanguage(), "function_declaration", "name"},
+	".py":   {python.GetLanguage(), "function_definition", byField("name")},
+	".java": {java.GetLanguage(), "method_declaration", byField("name")},
+	".cpp":  {cpp.GetLanguage(), "function_definition", declaratorName},
+	".hpp":  {cpp.GetLanguage(), "function_definition", declaratorName},
+	".h":    {cpp.GetLanguage(), "function_definition", declaratorName},
+	".go":   {golang.GetLanguage(), "function_declaration", byField("name")},
 }
 
-// functionInfo represents a single function extracted from source code.
-// Name holds the function's identifier and Code contains its source snippet.
-type functionInfo struct {
-	Name string
-	Code []byte
+// nameFunc は関数ノードから関数名を取り出す言語ごとの戦略。
+type nameFunc func(n *sitter.Node, src []byte) string
+
+// decisionNodeTypes は循環的複雑度の概算に用いる分岐ノードの種類。
+// 各言語の if/for/while/case 相当のノードを列挙している。
+var decisionNodeTypes = map[string]struct{}{
+	"if_statement":           {},
+	"elif_clause":            {},
+	"for_statement":          {},
+	"for_range_loop":         {},
+	"enhanced_for_statement": {},
+	"while_statement":        {},
+	"do_statement":           {},
+	"case_statement":         {},
+	"switch_label":           {},
+	"expression_case":        {},
+	"type_case":              {},
+	"communication_case":     {},
+	"case_clause":            {},
+	"catch_clause":           {},
+	"except_clause":          {},
+	"conditional_expression": {},
+	"ternary_expression":     {},
+}
+
+// Chunk はソースから抽出した 1 つの関数。カスタム抽出器が返す単位でもある。
+type Chunk struct {
+	Name       string   // 関数名
+	Code       []byte   // 関数のソース
+	Complexity int      // 循環的複雑度の概算（1 + 分岐の数）
+	Doc        string   // 直前の docstring やドキュメントコメント
+	StartLine  int      // 開始行（1 始まり）
+	EndLine    int      // 終了行（1 始まり）
+	Blame      string   // この範囲を最後に変更したコミットの要約
+	Neighbors  string   // 前後の関数のシグネチャ
+	Callees    []string // 関数内で呼び出している関数名
+	Lang       string   // 空でなければプロンプトの言語キーを上書きする（Markdown のコードブロックなど）
+
+	// comments はコメントノードの Code 内での位置、docstring は Python の
+	// docstring の位置。strip_comments で除去する範囲として使う。
+	comments  []byteRange
+	docstring *byteRange
+	// Stripped は strip_comments によりコメントを除去したかを表す。
+	Stripped bool
+	// batch は batch_size で連結したチャンクの場合に含まれるチャンク数。
+	batch int
+	// modifiers は Java の public などの修飾子。exported_only の判定に使う。
+	modifiers []string
+	// sig は近傍の文脈に載せる定義の先頭行。デコレータや注釈は含めない。
+	sig string
+}
+
+// byteRange は Code 内のバイト位置 [start, end)。
+type byteRange struct {
+	start, end int
 }
 
 // extractFunctions は Tree-sitter を利用してソースから関数ブロックのみを
-// 抽出するヘルパー。言語定義とノード種別、名前取得用フィールド名を受け取り、
-// 再帰的に構文木を探索して対象ノードのコード片と関数名を返す。
-func extractFunctions(src []byte, lang *sitter.Language, nodeType, nameField string) ([]functionInfo, error) {
+// 抽出するヘルパー。言語定義とノード種別、名前の取得方法を受け取り、
+// walkTree で構文木を走査して対象ノードのコード片と関数名を返す。
+// 構文エラーを含むファイルでも抽出できた関数は返し、partial を true にする。
+func extractFunctions(src []byte, lang *sitter.Language, nodeType string, name nameFunc) (funcs []Chunk, partial bool, err error) {
 	parser := sitter.NewParser() // パーサ生成
 	defer parser.Close()
 	parser.SetLanguage(lang) // 解析対象の言語を設定
@@ -83,32 +145,363 @@ func extractFunctions(src []byte, lang *sitter.Language, nodeType, nameField str
 	// ソースコードをパースして構文木を取得
 	tree, err := parser.ParseCtx(context.Background(), nil, src)
 	if err != nil {
-		return nil, fmt.Errorf("parse source: %w", err)
+		return nil, false, &ParseError{Err: err}
 	}
 
 	root := tree.RootNode()
-	var funcs []functionInfo
+	includeDecorators := !viper.IsSet("include_decorators") || viper.GetBool("include_decorators")
 	// DFS でノードを走査し関数ノードを収集
-	var walk func(n *sitter.Node)
-	walk = func(n *sitter.Node) {
+	walkTree(root, func(n *sitter.Node) bool {
 		if n.Type() == nodeType {
-			name := extractName(n, nameField, src)
-			funcs = append(funcs, functionInfo{
-				Name: name,
-				Code: src[n.StartByte():n.EndByte()],
+			// Python のデコレータは関数ノードの外側にあるため、チャンクの範囲を広げて含める
+			outer := n
+			if includeDecorators {
+				outer = decoratedNode(n)
+			}
+			funcs = append(funcs, Chunk{
+				Name:       name(n, src),
+				Code:       src[outer.StartByte():n.EndByte()],
+				Complexity: complexity(n),
+				Callees:    callees(n, src),
+				Doc:        extractDoc(n, src),
+				StartLine:  int(outer.StartPoint().Row) + 1,
+				EndLine:    int(n.EndPoint().Row) + 1,
+				comments:   commentRanges(outer),
+				docstring:  docstringRange(n, int(outer.StartByte())),
+				modifiers:  modifiers(n),
+				sig:        signature(src[signatureStart(n):n.EndByte()]),
 			})
 		}
-		for i := 0; i < int(n.NamedChildCount()); i++ {
-			walk(n.NamedChild(i))
+		return true
+	})
+	return funcs, root.HasError(), nil
+}
+
+// walkTree は n 以下の名前付きノードを行きがけ順に訪問する。深い入れ子でも
+// スタックを溢れさせないよう、再帰ではなく明示的なスタックで走査する。
+// visit が false を返したノードの子は訪問しない。
+func walkTree(n *sitter.Node, visit func(*sitter.Node) bool) {
+	stack := []*sitter.Node{n}
+	for len(stack) > 0 {
+		nn := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !visit(nn) {
+			continue
+		}
+		// 子を逆順に積み、先頭の子から取り出されるようにする
+		for i := int(nn.NamedChildCount()) - 1; i >= 0; i-- {
+			stack = append(stack, nn.NamedChild(i))
+		}
+	}
+}
+
+// extractModule はファイル全体（モジュールレベルの文）を 1 つのチャンクとして
+// 返す。関数定義を持たないスクリプト形式のファイルをレビューするために用いる。
+func extractModule(src []byte, lang *sitter.Language) (Chunk, error) {
+	parser := sitter.NewParser()
+	defer parser.Close()
+	parser.SetLanguage(lang)
+
+	tree, err := parser.ParseCtx(context.Background(), nil, src)
+	if err != nil {
+		return Chunk{}, &ParseError{Err: err}
+	}
+	root := tree.RootNode()
+	return Chunk{
+		Name:       "<module>",
+		Code:       src,
+		Complexity: complexity(root),
+		StartLine:  int(root.StartPoint().Row) + 1,
+		EndLine:    int(root.EndPoint().Row) + 1,
+	}, nil
+}
+
+// todoMarkers は review_todos で対象とするコメントの目印を返す。
+// todo_markers 未指定時は TODO / FIXME / HACK。
+func todoMarkers() []string {
+	if m := viper.GetStringSlice("todo_markers"); len(m) > 0 {
+		return m
+	}
+	return []string{"TODO", "FIXME", "HACK"}
+}
+
+// extractMarkedComments は markers のいずれかを含むコメントノードを抽出する。
+// チャンク名には一致した目印を用いる。
+func extractMarkedComments(src []byte, lang *sitter.Language, markers []string) ([]Chunk, error) {
+	parser := sitter.NewParser()
+	defer parser.Close()
+	parser.SetLanguage(lang)
+
+	tree, err := parser.ParseCtx(context.Background(), nil, src)
+	if err != nil {
+		return nil, &ParseError{Err: err}
+	}
+	var comments []Chunk
+	walkTree(tree.RootNode(), func(n *sitter.Node) bool {
+		if strings.Contains(n.Type(), "comment") {
+			text := n.Content(src)
+			for _, m := range markers {
+				if strings.Contains(text, m) {
+					comments = append(comments, Chunk{
+						Name:      m,
+						Code:      []byte(text),
+						StartLine: int(n.StartPoint().Row) + 1,
+						EndLine:   int(n.EndPoint().Row) + 1,
+					})
+					break
+				}
+			}
+		}
+		return true
+	})
+	return comments, nil
+}
+
+// commentRanges は関数ノード n 配下のコメントノードの位置を n からの相対位置で返す。
+func commentRanges(n *sitter.Node) []byteRange {
+	base := int(n.StartByte())
+	var ranges []byteRange
+	walkTree(n, func(nn *sitter.Node) bool {
+		if strings.Contains(nn.Type(), "comment") {
+			ranges = append(ranges, byteRange{int(nn.StartByte()) - base, int(nn.EndByte()) - base})
+			return false
+		}
+		return true
+	})
+	return ranges
+}
+
+// docstringRange は Python の関数本体先頭にある docstring 文の位置を、
+// チャンク先頭のバイト位置 base からの相対位置で返す。
+func docstringRange(n *sitter.Node, base int) *byteRange {
+	body := n.ChildByFieldName("body")
+	if body == nil || body.NamedChildCount() == 0 {
+		return nil
+	}
+	first := body.NamedChild(0)
+	if first.Type() != "expression_statement" || first.NamedChildCount() == 0 || first.NamedChild(0).Type() != "string" {
+		return nil
+	}
+	return &byteRange{int(first.StartByte()) - base, int(first.EndByte()) - base}
+}
+
+// stripComments はチャンクのコードからコメントを取り除いたコピーを返す。
+// keepDocstrings が false の場合は Python の docstring も取り除く。
+// コメントだけが書かれていた行は行ごと削除する。
+func stripComments(fn Chunk, keepDocstrings bool) Chunk {
+	ranges := append([]byteRange(nil), fn.comments...)
+	if !keepDocstrings && fn.docstring != nil {
+		ranges = append(ranges, *fn.docstring)
+	}
+	if len(ranges) == 0 {
+		return fn
+	}
+	// コメント部分を改行以外の空白で塗りつぶし、行の対応を保ったまま除去する
+	blanked := append([]byte(nil), fn.Code...)
+	for _, r := range ranges {
+		for i := r.start; i < r.end && i < len(blanked); i++ {
+			if blanked[i] != '\n' {
+				blanked[i] = ' '
+			}
+		}
+	}
+
+	var out []string
+	orig := strings.Split(string(fn.Code), "\n")
+	for i, line := range strings.Split(string(blanked), "\n") {
+		trimmed := strings.TrimRight(line, " \t")
+		if trimmed == "" && strings.TrimSpace(orig[i]) != "" {
+			// コメントだけが書かれていた行は行ごと落とす
+			continue
+		}
+		out = append(out, trimmed)
+	}
+	fn.Code = []byte(strings.Join(out, "\n"))
+	fn.comments, fn.docstring = nil, nil
+	fn.Stripped = true
+	return fn
+}
+
+// complexity はノード配下の分岐ノード数に 1 を加えた値を返す。
+func complexity(n *sitter.Node) int {
+	c := 1
+	walkTree(n, func(nn *sitter.Node) bool {
+		if _, ok := decisionNodeTypes[nn.Type()]; ok && !isDefaultLabel(nn) {
+			c++
+		}
+		return true
+	})
+	return c
+}
+
+// isDefaultLabel は Java の switch_label や C/C++ の case_statement のうち、
+// 分岐を増やさない default ラベルかを判定する。
+func isDefaultLabel(n *sitter.Node) bool {
+	return n.ChildCount() > 0 && n.Child(0).Type() == "default"
+}
+
+// modifiers は Java のメソッド宣言などが持つ修飾子キーワードを返す。
+// アノテーションは含めない。
+func modifiers(n *sitter.Node) []string {
+	var mods []string
+	for i := 0; i < int(n.ChildCount()); i++ {
+		c := n.Child(i)
+		if c.Type() != "modifiers" {
+			continue
+		}
+		for j := 0; j < int(c.ChildCount()); j++ {
+			if m := c.Child(j); !m.IsNamed() {
+				mods = append(mods, m.Type())
+			}
+		}
+	}
+	return mods
+}
+
+// isExported はチャンクが言語ごとの規則で公開された関数かを判定する。
+// Go は大文字で始まる名前、Python は _ で始まらない名前、Java は public
+// 修飾子を公開とみなす。公開の概念を判定できない言語では常に true。
+func isExported(ext string, fn Chunk) bool {
+	switch ext {
+	case ".go":
+		r, _ := utf8.DecodeRuneInString(fn.Name)
+		return unicode.IsUpper(r)
+	case ".py":
+		return !strings.HasPrefix(fn.Name, "_")
+	case ".java":
+		return slices.Contains(fn.modifiers, "public")
+	}
+	return true
+}
+
+// callNodeTypes は関数呼び出しを表すノード種別と、呼び出し先を示すフィールド名。
+var callNodeTypes = map[string]string{
+	"call":              "function", // Python
+	"call_expression":   "function", // C++ / Go
+	"method_invocation": "name",     // Java
+}
+
+// callees はノード配下で呼び出されている関数名を出現順に重複なく返す。
+// 名前解決は行わず、呼び出し式に書かれた名前（例: fmt.Println）をそのまま使う。
+func callees(n *sitter.Node, src []byte) []string {
+	var names []string
+	seen := map[string]struct{}{}
+	walkTree(n, func(nn *sitter.Node) bool {
+		field, ok := callNodeTypes[nn.Type()]
+		if !ok {
+			return true
+		}
+		target := nn.ChildByFieldName(field)
+		if target == nil {
+			return true
+		}
+		name := target.Content(src)
+		if obj := nn.ChildByFieldName("object"); obj != nil && field == "name" {
+			name = obj.Content(src) + "." + name
+		}
+		name = strings.Join(strings.Fields(name), "")
+		if _, dup := seen[name]; !dup {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+		return true
+	})
+	return names
+}
+
+// decoratedNode は n が Python のデコレータ付き定義の中身であれば、
+// デコレータを含む外側の decorated_definition ノードを返す。そうでなければ n。
+func decoratedNode(n *sitter.Node) *sitter.Node {
+	if p := n.Parent(); p != nil && p.Type() == "decorated_definition" {
+		return p
+	}
+	return n
+}
+
+// extractDoc は関数に付随するドキュメントを返す。Python のように本体先頭の
+// 文字列リテラルが docstring となる場合はそれを、そうでなければ直前に連続する
+// コメントノードを連結して返す。
+func extractDoc(n *sitter.Node, src []byte) string {
+	if body := n.ChildByFieldName("body"); body != nil && body.NamedChildCount() > 0 {
+		first := body.NamedChild(0)
+		if first.Type() == "expression_statement" && first.NamedChildCount() > 0 &&
+			first.NamedChild(0).Type() == "string" {
+			return first.NamedChild(0).Content(src)
+		}
+	}
+	var comments []string
+	for p := decoratedNode(n).PrevNamedSibling(); p != nil && strings.Contains(p.Type(), "comment"); p = p.PrevNamedSibling() {
+		comments = append([]string{p.Content(src)}, comments...)
+	}
+	return strings.Join(comments, "\n")
+}
+
+// byField returns a nameFunc that reads the name from the given field.
+func byField(field string) nameFunc {
+	return func(n *sitter.Node, src []byte) string {
+		return extractName(n, field, src)
+	}
+}
+
+// declaratorNameTypes are C/C++ declarator node types that carry the
+// function name itself.
+var declaratorNameTypes = map[string]struct{}{
+	"identifier":           {},
+	"field_identifier":     {},
+	"qualified_identifier": {},
+	"destructor_name":      {},
+	"operator_name":        {},
+	"template_function":    {},
+}
+
+// declaratorName follows the C/C++ declarator chain (pointer, reference and
+// function declarators) down to the node naming the function. Qualified
+// names such as Foo::bar are returned in full so that methods of different
+// classes can be told apart.
+func declaratorName(n *sitter.Node, src []byte) string {
+	d := n.ChildByFieldName("declarator")
+	for d != nil {
+		if _, ok := declaratorNameTypes[d.Type()]; ok {
+			return d.Content(src)
+		}
+		next := d.ChildByFieldName("declarator")
+		if next == nil && d.NamedChildCount() > 0 {
+			// reference_declarator has no declarator field; use its last child.
+			next = d.NamedChild(int(d.NamedChildCount()) - 1)
+			if next.Type() == "parameter_list" {
+				next = nil
+			}
+		}
+		d = next
+	}
+	return extractName(n, "declarator", src)
+}
+
+// goTypeName returns the name of the first type spec in a Go type declaration.
+func goTypeName(n *sitter.Node, src []byte) string {
+	for i := 0; i < int(n.NamedChildCount()); i++ {
+		c := n.NamedChild(i)
+		if c.Type() != "type_spec" && c.Type() != "type_alias" {
+			continue
+		}
+		if name := c.ChildByFieldName("name"); name != nil {
+			return name.Content(src)
 		}
 	}
-	walk(root)
-	return funcs, nil
+	return ""
+}
+
+// mergeByLine は 2 つのチャンク列をソース上の出現順に並べて結合する。
+func mergeByLine(a, b []Chunk) []Chunk {
+	merged := append(append([]Chunk(nil), a...), b...)
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].StartLine < merged[j].StartLine })
+	return merged
 }
 
 // extractName returns the function name using the specified field name.
-// When the field node is complex (e.g., C++ declarator), it searches for the
-// first identifier within that node.
+// A leaf field node (identifier, or field_identifier for Go methods) is the
+// name itself. When the field node is complex (e.g., C++ declarator), it
+// searches for the first identifier within that node.
 func extractName(n *sitter.Node, field string, src []byte) string {
 	if field == "" {
 		return ""
@@ -117,190 +510,2190 @@ func extractName(n *sitter.Node, field string, src []byte) string {
 	if m == nil {
 		return ""
 	}
-	if m.Type() == "identifier" {
+	if m.Type() == "identifier" || m.ChildCount() == 0 {
 		return m.Content(src)
 	}
 	var id *sitter.Node
-	var walk func(*sitter.Node)
-	walk = func(nn *sitter.Node) {
-		if nn == nil || id != nil {
-			return
+	walkTree(m, func(nn *sitter.Node) bool {
+		if id != nil {
+			return false
 		}
 		if nn.Type() == "identifier" {
 			id = nn
-			return
+			return false
 		}
-		for i := 0; i < int(nn.NamedChildCount()); i++ {
-			walk(nn.NamedChild(i))
-		}
-	}
-	walk(m)
+		return true
+	})
 	if id != nil {
 		return id.Content(src)
 	}
 	return ""
 }
 
-// buildPrompt はテンプレートファイルを読み込み、言語名とコードを埋め込んだ
-// プロンプト文字列を生成する。
-func buildPrompt(tmplPath, lang string, code []byte) (string, error) {
-	// テンプレートをパース
-	tmpl, err := template.ParseFiles(tmplPath)
+// loadGuideline は設定キー key が指すガイドラインのテンプレートファイルを
+// 読み込む。パスが存在しない・通常ファイルでない場合は、キーとパスを示す
+// エラーを返す。partials には {{ template "name" }} で参照する部品テンプレートのパスまたは
+// glob を指定でき、ガイドライン本体と同じテンプレート集合として解析される。
+func loadGuideline(key string, partials []string) (*template.Template, error) {
+	files, err := guidelineFiles(key, partials)
+	if err != nil {
+		return nil, err
+	}
+	// 先頭のファイル（ガイドライン本体）が実行対象のテンプレートになる
+	tmpl, err := template.ParseFiles(files...)
+	if err != nil {
+		return nil, &TemplateError{Op: "parse", Err: err}
+	}
+	return tmpl, nil
+}
+
+// guidelineFiles は設定キー key のガイドライン本体と partials に一致する
+// 部品テンプレートのパスを、本体を先頭にして返す。
+func guidelineFiles(key string, partials []string) ([]string, error) {
+	tmplPath := viper.GetString(key)
+	info, err := os.Stat(tmplPath)
+	switch {
+	case tmplPath == "":
+		return nil, fmt.Errorf("%s: no template path configured", key)
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("%s %q: file does not exist", key, tmplPath)
+	case err != nil:
+		return nil, fmt.Errorf("%s %q: %w", key, tmplPath, err)
+	case info.IsDir():
+		return nil, fmt.Errorf("%s %q: is a directory, expected a template file", key, tmplPath)
+	case !info.Mode().IsRegular():
+		return nil, fmt.Errorf("%s %q: not a regular file", key, tmplPath)
+	}
+	files := []string{tmplPath}
+	for _, p := range partials {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("guideline_partials %q: %w", p, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("guideline_partials %q: no files matched", p)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// guidelineHash はガイドライン本体と部品テンプレートの内容から求めた
+// ハッシュを返す。どの版のガイドラインでレビューしたかをレポートに残すために用いる。
+func guidelineHash(key string, partials []string) (string, error) {
+	files, err := guidelineFiles(key, partials)
 	if err != nil {
-		return "", fmt.Errorf("parse template: %w", err)
+		return "", err
+	}
+	h := sha256.New()
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.Base(f), len(b))
+		h.Write(b)
 	}
+	return hex.EncodeToString(h.Sum(nil))[:12], nil
+}
 
+// buildPrompt はガイドラインテンプレートに言語名とコード（および
+// docstring）を埋め込んだプロンプト文字列を生成する。
+func buildPrompt(tmpl *template.Template, lang string, fn Chunk) (string, error) {
 	// テンプレートに渡すデータ
 	data := map[string]string{
-		"lang": lang,
-		"code": string(code),
+		"lang":      lang,
+		"code":      string(fn.Code),
+		"doc":       fn.Doc,
+		"blame":     fn.Blame,
+		"neighbors": fn.Neighbors,
+		"callees":   strings.Join(fn.Callees, ", "),
+		// レビュー本文の自然言語（例: Japanese）
+		"review_language": viper.GetString("review_language"),
 	}
 
 	// 実行して結果をバッファへ書き出す
 	var buf strings.Builder
 	if err := tmpl.Execute(&buf, data); err != nil {
-		return "", fmt.Errorf("execute template: %w", err)
+		return "", &TemplateError{Op: "execute", Err: err}
 	}
 
 	return buf.String(), nil
 }
 
+// fitPrompt はプロンプトを生成し、上限（promptOverLimit）を超える場合は近傍の
+// シグネチャ・blame・docstring・呼び出し先といった省略可能な文脈を外して作り直す。
+// それでも超える場合は truncation の方針でコードを切り詰め、省略した行数を
+// 返す。prompt_overflow が skip の場合は文脈を外さず truncation も適用せずに、
+// truncation が skip（既定）で文脈を外してもなお超える場合は PromptTooLargeError を返す。
+func fitPrompt(tmpl *template.Template, lang string, fn Chunk) (string, int, error) {
+	prompt, err := buildPrompt(tmpl, lang, fn)
+	if err != nil {
+		return "", 0, err
+	}
+	over := promptOverLimit(prompt)
+	if over == nil {
+		return prompt, 0, nil
+	}
+	if viper.GetString("prompt_overflow") == "skip" {
+		return "", 0, over
+	}
+	log.Printf("Prompt for %s: %v; dropping optional context", fn.Name, over)
+	fn.Neighbors, fn.Blame, fn.Doc, fn.Callees = "", "", "", nil
+	if prompt, err = buildPrompt(tmpl, lang, fn); err != nil {
+		return "", 0, err
+	}
+	if over = promptOverLimit(prompt); over == nil {
+		return prompt, 0, nil
+	}
+	if strategy := viper.GetString("truncation"); strategy != "" && strategy != truncateSkip {
+		log.Printf("Prompt for %s: %v; truncating code (%s)", fn.Name, over, strategy)
+		return truncatePrompt(tmpl, lang, fn, strategy, over)
+	}
+	return "", 0, over
+}
+
+// promptOverLimit はプロンプトが max_prompt_bytes、または Tokenizer で
+// 見積もったトークン数が max_prompt_tokens を超えていればその旨のエラーを返す。
+func promptOverLimit(prompt string) *PromptTooLargeError {
+	if limit := viper.GetInt("max_prompt_bytes"); limit > 0 && len(prompt) > limit {
+		return &PromptTooLargeError{Size: len(prompt), Limit: limit, Key: "max_prompt_bytes"}
+	}
+	if limit := viper.GetInt("max_prompt_tokens"); limit > 0 {
+		if n := estimateTokens(prompt); n > limit {
+			return &PromptTooLargeError{Size: n, Limit: limit, Key: "max_prompt_tokens"}
+		}
+	}
+	return nil
+}
+
+// reviewResult は 1 チャンクのレビュー結果。Raw はモデルが返したそのままの
+// テキスト、Truncated は出力トークン上限で応答が打ち切られたかを表す。
+// PromptTokens と OutputTokens はサーバが報告した入力・出力のトークン数。
+// OmittedLines は truncation によりプロンプトから省いたコードの行数。
+type reviewResult struct {
+	Raw          string
+	Truncated    bool
+	PromptTokens int
+	OutputTokens int
+	OmittedLines int
+	// byModel は compare_models で各モデルから得た結果。トークン数の集計に用いる。
+	byModel map[string]reviewResult
+}
+
+// Markdown はレポートに載せる本文を返す。打ち切られた応答や、コードを
+// 切り詰めてレビューした結果にはその旨を添える。
+func (res reviewResult) Markdown() string {
+	md := res.Raw
+	if res.OmittedLines > 0 {
+		// レビューがコードの一部だけを対象にしている旨を明記する
+		md += fmt.Sprintf("\n\n> **Note:** code truncated to fit the prompt limit (truncation: %s); %d lines were not reviewed.", viper.GetString("truncation"), res.OmittedLines)
+	}
+	if res.Truncated {
+		// 出力トークン上限に達した応答は途中で切れている旨を明記する
+		md += fmt.Sprintf("\n\n> **Note:** response truncated at max_output_tokens (%d).", viper.GetInt("max_output_tokens"))
+	}
+	return md
+}
+
+// echoModel はテンプレート調整用の組み込みモデル名。model: echo を指定すると
+// Ollama に接続せず、描画したプロンプトをレビュー結果として返す。
+const echoModel = "echo"
+
 // reviewChunk は 1 つのチャンクを Ollama に送信し、レビュー結果を取得する
 // ヘルパー関数。
-func reviewChunk(ctx context.Context, client *api.Client, model string, guideline string, lang string, code []byte) (string, error) {
+func reviewChunk(ctx context.Context, client *api.Client, model string, guideline *template.Template, lang string, fn Chunk, opts map[string]any) (reviewResult, error) {
 	// プロンプトの生成
-	prompt, err := buildPrompt(guideline, lang, code)
+	prompt, omitted, err := fitPrompt(guideline, lang, fn)
 	if err != nil {
-		return "", err
+		return reviewResult{}, err
+	}
+	if model == echoModel {
+		// Ollama に問い合わせず、描画したプロンプトをそのまま結果とする
+		return reviewResult{Raw: "````text\n" + prompt + "\n````", OmittedLines: omitted}, nil
 	}
 
 	// Ollama API へ送るチャットリクエストを準備
+	var messages []api.Message
+	if l := viper.GetString("review_language"); l != "" {
+		// 指定された自然言語で回答するようシステム指示を与える
+		messages = append(messages, api.Message{Role: "system", Content: fmt.Sprintf("Respond in %s.", l)})
+	}
+	if fn.batch > 0 {
+		// まとめたチャンクはそれぞれのレビューを区切り行で分けて返させる
+		messages = append(messages, api.Message{Role: "system", Content: fmt.Sprintf(batchInstruction, fn.batch)})
+	}
+	// few-shot の例がある場合はレビュー対象より前に差し込む
+	examples, err := fewShotMessages()
+	if err != nil {
+		return reviewResult{}, err
+	}
+	messages = append(messages, examples...)
+
+	if viper.GetString("mode") == "generate" {
+		res, err := generateReview(ctx, client, model, messages, prompt, opts)
+		res.OmittedLines = omitted
+		return res, err
+	}
 	req := &api.ChatRequest{
 		Model:    model,
-		Messages: []api.Message{{Role: "user", Content: prompt}},
+		Messages: append(messages, api.Message{Role: "user", Content: prompt}),
+		Options:  opts,
 	}
 
 	var outBuf bytes.Buffer
+	var res reviewResult
 	// ストリームをまとめてバッファに蓄積する
 	err = client.Chat(ctx, req, func(resp api.ChatResponse) error {
 		outBuf.WriteString(resp.Message.Content)
+		if resp.Done {
+			res.Truncated = resp.DoneReason == "length"
+			res.PromptTokens, res.OutputTokens = resp.PromptEvalCount, resp.EvalCount
+		}
 		return nil
 	})
 	if err != nil {
-		return "", err
+		return reviewResult{}, &OllamaError{Model: model, Err: err}
 	}
-	return outBuf.String(), nil
+	res.Raw = outBuf.String()
+	res.OmittedLines = omitted
+	return res, nil
 }
 
-// processFile は単一ファイルを解析してレビュー結果を report に追記するヘルパー。
-func processFile(ctx context.Context, path string, report *[]string, model, guidelinePath string) error {
-	if ctx.Err() != nil {
-		return ctx.Err()
+// generateReview は mode: generate 用に /api/generate でレビューを取得する。
+// システム指示は System に、few-shot の例はプロンプトの前にテキストとして渡す。
+func generateReview(ctx context.Context, client *api.Client, model string, history []api.Message, prompt string, opts map[string]any) (reviewResult, error) {
+	var system []string
+	var pre strings.Builder
+	for _, m := range history {
+		switch m.Role {
+		case "system":
+			system = append(system, m.Content)
+		case "user":
+			fmt.Fprintf(&pre, "%s\n\n", m.Content)
+		case "assistant":
+			fmt.Fprintf(&pre, "%s\n\n---\n\n", m.Content)
+		}
 	}
-	ext := filepath.Ext(path)
-	cfg, ok := langConfig[ext]
-	if !ok {
-		return nil
+	req := &api.GenerateRequest{
+		Model:   model,
+		Prompt:  pre.String() + prompt,
+		System:  strings.Join(system, "\n"),
+		Options: opts,
 	}
-	log.Printf("Processing %s", path)
 
-	src, err := os.ReadFile(path)
-	if err != nil {
-		log.Printf("Read error %s: %v", path, err)
+	var outBuf bytes.Buffer
+	var res reviewResult
+	// ストリームをまとめてバッファに蓄積する
+	err := client.Generate(ctx, req, func(resp api.GenerateResponse) error {
+		outBuf.WriteString(resp.Response)
+		if resp.Done {
+			res.Truncated = resp.DoneReason == "length"
+			res.PromptTokens, res.OutputTokens = resp.PromptEvalCount, resp.EvalCount
+		}
 		return nil
-	}
-	funcs, err := extractFunctions(src, cfg.lang, cfg.nodeType, cfg.nameField)
+	})
 	if err != nil {
-		log.Printf("Parse error %s: %v", path, err)
-		return nil
+		return reviewResult{}, &OllamaError{Model: model, Err: err}
 	}
-	if len(funcs) == 0 {
-		log.Printf("No functions found in %s", path)
-		return nil
+	res.Raw = outBuf.String()
+	return res, nil
+}
+
+// fewShotExample は few_shot 設定の 1 組（ユーザ発話とその模範応答）。
+type fewShotExample struct {
+	User      string `mapstructure:"user"`
+	Assistant string `mapstructure:"assistant"`
+}
+
+// fewShotMessages は few_shot 設定をチャット履歴のメッセージ列に変換する。
+func fewShotMessages() ([]api.Message, error) {
+	var examples []fewShotExample
+	if err := viper.UnmarshalKey("few_shot", &examples); err != nil {
+		return nil, fmt.Errorf("parse few_shot: %w", err)
 	}
-	baseURL, err := url.Parse(viper.GetString("OllamaHost"))
-	if err != nil {
-		return fmt.Errorf("parse OLLAMA_HOST: %w", err)
+	var msgs []api.Message
+	for _, ex := range examples {
+		msgs = append(msgs,
+			api.Message{Role: "user", Content: ex.User},
+			api.Message{Role: "assistant", Content: ex.Assistant},
+		)
 	}
-	client := api.NewClient(baseURL, http.DefaultClient)
-	for i, fn := range funcs {
-		if ctx.Err() != nil {
-			return ctx.Err()
-		}
-		sp := spinner.New(spinner.CharSets[14], 100*time.Millisecond)
-		sp.Suffix = fmt.Sprintf(" %s[%s] chunk %d/%d reviewing...", path, fn.Name, i+1, len(funcs))
-		sp.Start()
-		res, err := reviewChunk(ctx, client, model, guidelinePath, strings.TrimPrefix(ext, "."), fn.Code)
-		sp.Stop()
-		if err != nil {
-			log.Printf("Review error %s[%d]: %v", path, i+1, err)
-			continue
-		}
-		log.Printf("%s chunk %d/%d reviewed", path, i+1, len(funcs))
-		log.Println(res)
-		*report = append(*report, fmt.Sprintf("## %s - %s (chunk %d/%d)\n\n%s\n\n---\n", path, fn.Name, i+1, len(funcs), res))
+	return msgs, nil
+}
+
+// chatOptions は設定から Ollama へ渡すモデルオプションを組み立てる。seed が
+// nil でなければ乱数シードとして渡す。指定がなければ nil を返し、サーバ側の
+// 既定値に任せる。
+func chatOptions(seed *int) map[string]any {
+	opts := map[string]any{}
+	if n := viper.GetInt("max_output_tokens"); n > 0 {
+		opts["num_predict"] = n
 	}
-	return nil
+	if seed != nil {
+		opts["seed"] = *seed
+	}
+	if viper.GetBool("deterministic") {
+		// 同じ seed で同じ応答を得られるようサンプリングを無効化する
+		opts["temperature"] = 0
+	}
+	if stop := viper.GetStringSlice("stop"); len(stop) > 0 {
+		// 生成しすぎるモデル向けに、既知の区切りで応答を打ち切らせる
+		opts["stop"] = stop
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	return opts
 }
 
-// Review はリポジトリ内を探索し、各ファイルの関数単位で AI にレビューを
-// 依頼するメイン関数。取得した結果は Markdown として保存される。
-func Review(ctx context.Context, repoRoot string, outFile string) error {
-	log.Printf("Start review: repo=%s", repoRoot)
-	rootDir := "." // WalkDir の起点
+// reviewRun は 1 回のレビュー実行で共有する状態をまとめたもの。
+// root はレビュー起点のパスで、レポート上のパス表記に用いる。
+type reviewRun struct {
+	client    *api.Client
+	root      string
+	model     string
+	guideline *template.Template
+	report    []string     // レビュー結果の Markdown セクション
+	routes    []modelRoute // チャンクごとのモデル選択ルール
 
-	// 使用するモデル名を設定ファイルから取得
-	model := viper.GetString("model")
+	todoGuideline *template.Template // TODO/FIXME コメント用のガイドライン
+	todoReport    []string           // TODO/FIXME コメントのレビュー結果
 
-	// 除外ディレクトリをマップ化して高速に判定
-	ignoreDirs := map[string]struct{}{}
-	for _, n := range viper.GetStringSlice("exclude") {
-		ignoreDirs[n] = struct{}{}
-	}
+	partialFiles int // 構文エラーを含み部分的にしか解析できなかったファイル数
+	reviewed     int // レビューに成功したチャンク数
+	failed       int // レビューに失敗したチャンク数
+	stripped     int // コメントを除去してレビューしたチャンク数
+	oversized    int // プロンプトが max_prompt_bytes を超えて読み飛ばしたチャンク数
+	resumed      int // state_file の記録から再利用したチャンク数
+	findings     int // finding_delimiter で区切られた指摘の数
 
-	guidelinePath := viper.GetString("guideline") // ガイドラインテンプレート
+	suppressed []string       // インラインの抑止コメントでレビューしなかったチャンク
+	clean      []string       // finding_delimiter 指定時に指摘がなかったチャンク
+	issues     map[string]int // 正規化した指摘の見出しごとの件数
 
-	// レビュー結果を格納するスライス
-	var report []string
+	state *runState // state_file 指定時のチャンクごとの完了状態
 
-	info, err := os.Stat(repoRoot)
-	if err != nil {
-		return err
+	guidelineHash string // ガイドラインの内容のハッシュ
+	stateKey      string // state_file の記録を再利用できるかを判定するキー
+
+	// changed は --patch / --diff 指定時のファイルごとの変更行範囲。nil でなければ
+	// 変更に重なる関数だけをレビューする。
+	changed map[string][]lineRange
+	// archive は zip / tar.gz を展開してレビューしている場合の元のパス。
+	archive string
+
+	// languages は言語キー（拡張子）ごとのレビュー済みファイル数とチャンク数。
+	languages map[string]*languageStats
+
+	// usage はモデルごとの消費トークン数。pricing の費用見積もりに用いる。
+	usage map[string]*tokenUsage
+
+	// skips は理由ごとの読み飛ばしたファイル数。解析は並行でも集計は
+	// 結果を順に受け取るゴルーチンだけが行うため、ロックは不要。
+	skips map[string]int
+
+	// budget は実行全体で残っている再試行回数。watch でファイルごとに
+	// 複製した実行とも共有する。
+	budget *retryBudget
+
+	concurrency int // 同時にレビューするチャンク数（concurrency）
+
+	seed    int            // この実行で用いる乱数シード（resolveSeed）
+	options map[string]any // Ollama へ渡すモデルオプション（chatOptions）
+
+	// flights は同じチャンクの並行なレビューを 1 回の要求にまとめる。budget と
+	// 同様に watch で複製した実行とも共有する。
+	flights *reviewFlights
+}
+
+// retryBudget は total_retry_budget のうち残っている再試行回数。チャンクを
+// 並行にレビューするワーカー間で共有するため排他制御する。
+type retryBudget struct {
+	mu       sync.Mutex
+	left     int  // 残りの再試行回数（負なら無制限）
+	exceeded bool // 予算を使い切った旨をログ出力済みか
+}
+
+// take は再試行を 1 回ぶん消費する。予算を使い切っていれば false を返す。
+// nil の場合は無制限として扱う。
+func (b *retryBudget) take() bool {
+	if b == nil {
+		return true
 	}
-	if info.IsDir() {
-		walkFn := func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				// パーミッションエラー等が発生した場合はそのまま返す
-				return err
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.left == 0 {
+		if !b.exceeded {
+			log.Printf("Retry budget exhausted; remaining failures will not be retried")
+			b.exceeded = true
+		}
+		return false
+	}
+	if b.left > 0 {
+		b.left--
+	}
+	return true
+}
+
+// errEmptyResponse はモデルが空の応答を返したことを表す。再試行のログにだけ使う。
+var errEmptyResponse = errors.New("empty response")
+
+// emptyResponseNote は再試行しても応答が空だったチャンクの節に載せる注記。
+const emptyResponseNote = "> **Note:** the model returned an empty response."
+
+// retryDelay は再試行までの待ち時間の単位。n 回目の再試行の前に n 倍だけ待つ。
+var retryDelay = time.Second
+
+// reviewWithRetry は Ollama との通信に失敗したチャンクを max_retries 回まで
+// 再試行する。再試行は実行全体の total_retry_budget からも差し引かれ、予算を
+// 使い切った後は再試行せずに失敗として扱う。空の応答も同様に再試行し、
+// それでも空なら emptyResponseNote を結果とする。
+func (r *reviewRun) reviewWithRetry(ctx context.Context, client *api.Client, model string, guideline *template.Template, lang string, fn Chunk) (reviewResult, error) {
+	maxRetries := viper.GetInt("max_retries")
+	for attempt := 0; ; attempt++ {
+		res, err := reviewChunk(ctx, client, model, guideline, lang, fn, r.options)
+		limit := maxRetries // この失敗に適用する再試行の上限（ログ用）
+		if err == nil && strings.TrimSpace(res.Raw) == "" {
+			// 空の応答は max_retries 回まで（少なくとも 1 回）再試行する
+			limit = max(maxRetries, 1)
+			if attempt >= limit || ctx.Err() != nil || !r.budget.take() {
+				log.Printf("Empty response for %s after %d attempt(s)", fn.Name, attempt+1)
+				res.Raw = emptyResponseNote
+				return res, nil
 			}
-			if ctx.Err() != nil {
-				return ctx.Err()
+			err = errEmptyResponse
+		} else {
+			var oe *OllamaError
+			if err == nil || !errors.As(err, &oe) || ctx.Err() != nil || attempt >= maxRetries {
+				return res, err
 			}
-			if d.IsDir() {
-				if _, ok := ignoreDirs[d.Name()]; ok && path != rootDir {
-					// 指定されたディレクトリは探索しない
-					return fs.SkipDir
-				}
-				return nil
+			if !r.budget.take() {
+				return res, err
 			}
-			return processFile(ctx, path, &report, model, guidelinePath)
-		}
-		if err := filepath.WalkDir(repoRoot, walkFn); err != nil && !errors.Is(err, context.Canceled) {
-			return err
 		}
-	} else {
-		if err := processFile(ctx, repoRoot, &report, model, guidelinePath); err != nil && !errors.Is(err, context.Canceled) {
-			return err
+		log.Printf("Retrying %s (%d/%d): %v", fn.Name, attempt+1, limit, err)
+		select {
+		case <-ctx.Done():
+			return reviewResult{}, ctx.Err()
+		case <-time.After(time.Duration(attempt+1) * retryDelay):
 		}
 	}
-	// まとめたレポートを Markdown ファイルへ出力
-	if err := os.WriteFile(outFile,
-		[]byte("# Code Review Report\n\n"+strings.Join(report, "")),
-		0644); err != nil {
-		return fmt.Errorf("write report: %w", err)
+}
+
+// languageStats は 1 言語ぶんのレビュー件数。
+type languageStats struct {
+	files  int
+	chunks int
+}
+
+// langStats は言語キー lang の集計を返す。なければ作成する。
+func (r *reviewRun) langStats(lang string) *languageStats {
+	if r.languages == nil {
+		r.languages = map[string]*languageStats{}
+	}
+	st, ok := r.languages[lang]
+	if !ok {
+		st = &languageStats{}
+		r.languages[lang] = st
+	}
+	return st
+}
+
+// countFiles は拡張子 ext のファイルを、含まれるチャンクの言語ごとに 1 件
+// 数える。Markdown のコードブロックのように 1 ファイルに複数の言語が含まれる
+// 場合は、それぞれの言語のファイルとして数える。
+func (r *reviewRun) countFiles(ext string, funcs, todos []Chunk) {
+	seen := map[string]bool{}
+	for _, chunks := range [][]Chunk{funcs, todos} {
+		for _, fn := range chunks {
+			if lang := chunkLang(ext, fn); !seen[lang] {
+				seen[lang] = true
+				r.langStats(lang).files++
+			}
+		}
+	}
+}
+
+// languageSection は言語ごとのレビュー件数を Markdown の表として返す。
+func (r *reviewRun) languageSection() string {
+	if len(r.languages) == 0 {
+		return ""
+	}
+	langs := make([]string, 0, len(r.languages))
+	for l := range r.languages {
+		langs = append(langs, l)
+	}
+	sort.Strings(langs)
+	var b strings.Builder
+	b.WriteString("# Languages\n\n| Language | Files | Chunks |\n| --- | --- | --- |\n")
+	for _, l := range langs {
+		st := r.languages[l]
+		fmt.Fprintf(&b, "| %s | %d | %d |\n", l, st.files, st.chunks)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// routeClient はルール route に一致したチャンクの要求に使うクライアントを返す。
+// ルールが独自のエンドポイントを持たなければ既定のクライアントを返す。
+func (r *reviewRun) routeClient(route modelRoute) *api.Client {
+	if route.client != nil {
+		return route.client
+	}
+	return r.client
+}
+
+// clientFor はチャンクのルールによらずモデル model へ送る要求（compare_models、
+// TODO/FIXME コメント、リポジトリ全体のレビューなど）に使うクライアントを返す。
+// model を指定した最初のルールが独自のエンドポイントを持てばそれを使う。
+func (r *reviewRun) clientFor(model string) *api.Client {
+	for _, route := range r.routes {
+		if route.Model == model && route.client != nil {
+			return route.client
+		}
+	}
+	return r.client
+}
+
+// compareReview は compare_models の各モデルで同じチャンクをレビューし、
+// モデル名の小見出しを付けて 1 つの結果にまとめる。一部のモデルが失敗しても
+// その旨を載せて続け、すべてのモデルが失敗した場合だけエラーを返す。
+func (r *reviewRun) compareReview(ctx context.Context, models []string, lang string, fn Chunk) (reviewResult, error) {
+	var parts []string
+	var lastErr error
+	succeeded := 0
+	byModel := map[string]reviewResult{}
+	for _, m := range models {
+		res, err := r.reviewWithRetry(ctx, r.clientFor(m), m, r.guideline, lang, fn)
+		var tooLarge *PromptTooLargeError
+		if err != nil && (ctx.Err() != nil || errors.As(err, &tooLarge)) {
+			return reviewResult{}, err
+		}
+		if err != nil {
+			log.Printf("Review error %s by %s: %v", fn.Name, m, err)
+			lastErr = err
+			parts = append(parts, fmt.Sprintf("### %s\n\n> **Note:** review failed: %v", m, err))
+			continue
+		}
+		succeeded++
+		byModel[m] = res
+		parts = append(parts, fmt.Sprintf("### %s\n\n%s", m, res.Markdown()))
+	}
+	if succeeded == 0 {
+		return reviewResult{}, lastErr
+	}
+	return reviewResult{Raw: strings.Join(parts, "\n\n"), byModel: byModel}, nil
+}
+
+// countSkip は理由 reason で読み飛ばしたファイルを数える。
+func (r *reviewRun) countSkip(reason string) {
+	if r.skips == nil {
+		r.skips = map[string]int{}
+	}
+	r.skips[reason]++
+}
+
+// skippedTotal は読み飛ばしたファイルの総数を返す。
+func (r *reviewRun) skippedTotal() int {
+	n := 0
+	for _, c := range r.skips {
+		n += c
+	}
+	return n
+}
+
+// skippedSection は理由ごとの読み飛ばし件数を Markdown の表として返す。
+func (r *reviewRun) skippedSection() string {
+	if len(r.skips) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("# Skipped Files\n\n| Reason | Files |\n| --- | --- |\n")
+	for _, reason := range skipReasons {
+		if n := r.skips[reason]; n > 0 {
+			fmt.Fprintf(&b, "| %s | %d |\n", reason, n)
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// summaryLine は CI で解析しやすい 1 行の実行サマリを返す。
+func (r *reviewRun) summaryLine() string {
+	line := fmt.Sprintf("reviewed=%d failed_chunks=%d oversized_chunks=%d partial_files=%d skipped_files=%d", r.reviewed, r.failed, r.oversized, r.partialFiles, r.skippedTotal())
+	if viper.GetString("finding_delimiter") != "" {
+		line += fmt.Sprintf(" findings=%d", r.findings)
+	}
+	return line
+}
+
+// writeSummary はサマリ行を出力し、GITHUB_STEP_SUMMARY が設定されていれば
+// そのファイルにも追記する。レポートを標準出力へ書く場合は標準エラーへ出す。
+func (r *reviewRun) writeSummary(outFile string) {
+	line := r.summaryLine()
+	w := os.Stdout
+	if outFile == stdoutPath {
+		w = os.Stderr
+	}
+	fmt.Fprintln(w, line)
+	if p := os.Getenv("GITHUB_STEP_SUMMARY"); p != "" {
+		f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Printf("Write step summary error: %v", err)
+			return
+		}
+		defer f.Close()
+		fmt.Fprintf(f, "`%s`\n", line)
+	}
+}
+
+// parsedFile は読み込みと関数抽出を終え、レビュー待ちとなったファイル。
+type parsedFile struct {
+	path  string
+	ext   string
+	funcs []Chunk
+	todos []Chunk // review_todos 有効時に抽出した TODO/FIXME コメント
+	// suppressed はインラインの抑止コメントによりレビューしない関数
+	suppressed []Chunk
+	partial    bool   // 構文エラーを含み抽出が不完全な可能性がある
+	skip       string // 空でなければレビューせずに読み飛ばした理由
+}
+
+// ファイルを読み飛ばした理由。レポートの Skipped Files 節に集計される。
+const (
+	skipReadError   = "read error"
+	skipParseError  = "parse error"
+	skipBinary      = "binary"
+	skipTooLarge    = "size limit"
+	skipEmpty       = "empty"
+	skipNoFunctions = "no functions"
+)
+
+// skipReasons は Skipped Files 節での表示順。
+var skipReasons = []string{skipReadError, skipParseError, skipBinary, skipTooLarge, skipEmpty, skipNoFunctions}
+
+// defaultChurnCommits は churn_commits 未指定時に変更回数を数えるコミット数。
+const defaultChurnCommits = 50
+
+// normalizeNewlines は CRLF と単独の CR を LF に置き換える。Tree-sitter は
+// LF だけを行区切りとして数えるため、CR のみの改行では行番号がずれ、CRLF では
+// チャンクのコードに CR が残る。改行の数は変わらないので行番号は保たれる。
+func normalizeNewlines(src []byte) []byte {
+	if bytes.IndexByte(src, '\r') < 0 {
+		return src
+	}
+	src = bytes.ReplaceAll(src, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(src, []byte("\r"), []byte("\n"))
+}
+
+// isBinary は先頭付近に NUL を含むファイルをバイナリとみなす。
+func isBinary(src []byte) bool {
+	head := src
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	return bytes.IndexByte(head, 0) >= 0
+}
+
+// processFile は単一ファイルを解析してレビュー結果を report に追記するヘルパー。
+// lines が指定された場合はその行範囲に重なる関数のみをレビューする。
+func (r *reviewRun) processFile(ctx context.Context, path string, lines *lineRange) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	pf, err := prepareFile(path, lines)
+	if err != nil || pf == nil {
+		return err
+	}
+	if pf.skip != "" {
+		r.countSkip(pf.skip)
+		return nil
+	}
+	return r.reviewFile(ctx, pf)
+}
+
+// prepareFile はファイルを読み込んで関数を抽出し、フィルタを適用する。
+// レビュー対象外のファイルでは nil を返す。レビュー実行の状態には触れないため
+// 複数ファイルを並行して処理できる。
+func prepareFile(path string, lines *lineRange) (*parsedFile, error) {
+	ext := filepath.Ext(path)
+	custom, hasCustom := lookupExtractor(ext)
+	fenced := false // Markdown のコードブロックをチャンクとするか
+	if ext == ".md" && !hasCustom && viper.GetBool("review_markdown") {
+		// Markdown はフェンスドコードブロックをチャンクとして取り出す
+		custom, hasCustom, fenced = extractFencedBlocks, true, true
+	}
+	cfg, ok := langConfig[ext]
+	if !ok && !hasCustom && viper.GetBool("use_editorconfig") {
+		// .editorconfig の language 指定で独自の拡張子を対応言語に割り当てる
+		if mapped := editorconfigLanguage(path); mapped != "" {
+			ext = mapped
+			cfg, ok = langConfig[ext]
+		}
+	}
+	if !ok && !hasCustom && viper.GetBool("detect_language") {
+		// 拡張子で判定できないファイルは shebang や内容から言語を推定する
+		if detected := detectLanguage(path); detected != "" {
+			ext = detected
+			cfg, ok = langConfig[ext]
+		}
+	}
+	if !ok && !hasCustom {
+		return nil, nil
+	}
+	if !fenced && !languageSelected(ext) {
+		// コードブロックの言語はブロックごとに異なるため抽出後に絞り込む
+		return nil, nil
+	}
+	log.Printf("Processing %s", path)
+
+	skipped := func(reason string) (*parsedFile, error) {
+		return &parsedFile{path: path, ext: ext, skip: reason}, nil
+	}
+	parseFailed := func(err error) (*parsedFile, error) {
+		if viper.GetBool("strict_parse") {
+			// strict_parse では解析できないファイルを実行全体の失敗とする
+			return nil, fmt.Errorf("strict_parse: cannot parse %s: %w", path, err)
+		}
+		log.Printf("Parse error %s: %v", path, err)
+		return skipped(skipParseError)
+	}
+	if limit := viper.GetInt64("max_file_bytes"); limit > 0 {
+		if info, err := os.Stat(path); err == nil && info.Size() > limit {
+			log.Printf("Skipping %s: %d bytes exceeds max_file_bytes", path, info.Size())
+			return skipped(skipTooLarge)
+		}
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Read error %s: %v", path, err)
+		return skipped(skipReadError)
+	}
+	if isBinary(src) {
+		log.Printf("Skipping binary file %s", path)
+		return skipped(skipBinary)
+	}
+	// 行番号がエディタの表示と一致するよう改行コードを LF にそろえる
+	src = normalizeNewlines(src)
+	if isBlankSource(src, ext) {
+		// 空・空白のみ・コメントのみのファイルはパースせずに読み飛ばす
+		return skipped(skipEmpty)
+	}
+	var funcs []Chunk
+	partial := false
+	if hasCustom {
+		// 登録済みの独自抽出器があれば Tree-sitter より優先する
+		funcs, err = custom(src)
+	} else {
+		funcs, partial, err = extractFunctions(src, cfg.lang, cfg.nodeType, cfg.name)
+		if err == nil && ext == ".go" && viper.GetBool("review_go_types") {
+			// interface や struct の型定義も API 設計のレビュー対象に加える
+			var types []Chunk
+			if types, _, err = extractFunctions(src, cfg.lang, "type_declaration", goTypeName); err == nil {
+				funcs = mergeByLine(funcs, types)
+			}
+		}
+	}
+	if err != nil {
+		return parseFailed(err)
+	}
+	if partial && viper.GetBool("strict_parse") {
+		return nil, fmt.Errorf("strict_parse: %s contains syntax errors", path)
+	}
+	if fenced && len(funcs) > 0 {
+		// コードブロックはファイルの拡張子ではなくブロック自身の言語で絞り込む
+		kept := funcs[:0]
+		for _, fn := range funcs {
+			if languageSelected(fn.Lang) {
+				kept = append(kept, fn)
+			}
+		}
+		if len(kept) == 0 {
+			return nil, nil
+		}
+		funcs = kept
+	}
+	if len(funcs) == 0 && !hasCustom && viper.GetBool("review_module_level") {
+		// 関数を含まないスクリプトはモジュール全体を 1 チャンクとしてレビューする
+		mod, err := extractModule(src, cfg.lang)
+		if err != nil {
+			return parseFailed(err)
+		}
+		funcs = []Chunk{mod}
+	}
+	if n := viper.GetInt("neighbor_context"); n > 0 {
+		// フィルタ前の全関数を基準に前後の関数シグネチャを付与する
+		addNeighbors(funcs, n)
+	}
+	if lines != nil {
+		if funcs, err = lines.apply(src, funcs); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if funcs, err = excludeFuncsByName(funcs); err != nil {
+		return nil, err
+	}
+	var suppressed []Chunk
+	if funcs, suppressed = splitSuppressed(src, funcs); len(suppressed) > 0 {
+		log.Printf("%s: %d chunk(s) suppressed by inline comment", path, len(suppressed))
+	}
+	if viper.GetBool("exported_only") {
+		// API レビュー向けに公開された関数だけを残す
+		kept := funcs[:0]
+		for _, fn := range funcs {
+			if isExported(ext, fn) {
+				kept = append(kept, fn)
+			}
+		}
+		funcs = kept
+	}
+	if minC := viper.GetInt("min_complexity"); minC > 0 {
+		// 複雑度がしきい値未満の関数はレビュー対象から外す
+		kept := funcs[:0]
+		for _, fn := range funcs {
+			if fn.Complexity >= minC {
+				kept = append(kept, fn)
+			}
+		}
+		funcs = kept
+	}
+	if minChurn := viper.GetInt("min_churn"); minChurn > 0 && gitAvailable() {
+		// 直近 churn_commits 件のコミットで変更回数がしきい値未満の関数は外す
+		commits := viper.GetInt("churn_commits")
+		if commits <= 0 {
+			commits = defaultChurnCommits
+		}
+		kept := funcs[:0]
+		for _, fn := range funcs {
+			if churnCount(path, fn.StartLine, fn.EndLine, commits) >= minChurn {
+				kept = append(kept, fn)
+			}
+		}
+		funcs = kept
+	}
+	var todos []Chunk
+	if viper.GetBool("review_todos") && !hasCustom {
+		if todos, err = extractMarkedComments(src, cfg.lang, todoMarkers()); err != nil {
+			log.Printf("Parse error %s: %v", path, err)
+		}
+	}
+	if len(funcs) == 0 && len(todos) == 0 {
+		if len(suppressed) > 0 {
+			// 抑止した関数だけのファイルもその旨をレポートに残す
+			return &parsedFile{path: path, ext: ext, suppressed: suppressed}, nil
+		}
+		log.Printf("No functions found in %s", path)
+		return skipped(skipNoFunctions)
+	}
+	if !viper.GetBool("include_docstrings") {
+		// docstring を渡さない設定ではテンプレートの doc を空にする
+		for i := range funcs {
+			funcs[i].Doc = ""
+		}
+	}
+	if !viper.GetBool("include_callees") {
+		// 呼び出し先の一覧を渡さない設定ではテンプレートの callees を空にする
+		for i := range funcs {
+			funcs[i].Callees = nil
+		}
+	}
+	if viper.GetBool("strip_comments") {
+		// トークン節約のためコメントを除去する（docstring は既定で残す）
+		keepDoc := !viper.IsSet("keep_docstrings") || viper.GetBool("keep_docstrings")
+		for i := range funcs {
+			funcs[i] = stripComments(funcs[i], keepDoc)
+		}
+	}
+	return &parsedFile{path: path, ext: ext, funcs: funcs, todos: todos, partial: partial, suppressed: suppressed}, nil
+}
+
+// reviewFile は抽出済みの関数を順にレビューし、結果を report に追記する。
+func (r *reviewRun) reviewFile(ctx context.Context, pf *parsedFile) error {
+	path, ext, funcs := pf.path, pf.ext, pf.funcs
+	for _, fn := range pf.suppressed {
+		r.suppressed = append(r.suppressed, fmt.Sprintf("%s - %s", r.reportPath(path), chunkLabel(fn, 0, 1)))
+	}
+	if len(funcs) == 0 && len(pf.todos) == 0 {
+		return nil
+	}
+	r.countFiles(ext, funcs, pf.todos)
+	if pf.partial {
+		// 構文エラーがあっても抽出できた関数はレビューし、網羅性が不完全な旨を残す
+		log.Printf("Partial parse %s: syntax errors found, coverage may be incomplete", path)
+		r.partialFiles++
+		r.report = append(r.report, fmt.Sprintf("## %s (parse errors)\n\n> **Note:** this file contains syntax errors; some functions may not have been reviewed.%s", r.reportPath(path), sectionEnd()))
+	}
+	ids := make([]string, len(funcs))
+	resumed := map[int]stateEntry{}
+	var pending []int // レビューが必要なチャンクの添字
+	for i, fn := range funcs {
+		ids[i] = chunkID(r.root, path, fn)
+		if r.state != nil {
+			// ガイドラインやプロンプトに関わる設定が変わった場合は記録済みの結果を再利用しない
+			if e, ok := r.state.lookup(r.stateKey + "/" + ids[i]); ok {
+				// 前回の実行で完了済みのチャンクは記録した節をそのまま使う
+				resumed[i] = e
+				continue
+			}
+		}
+		pending = append(pending, i)
+	}
+	var batched map[int]batchReview
+	if size := viper.GetInt("batch_size"); size > 1 && len(viper.GetStringSlice("compare_models")) == 0 {
+		// 同じファイルのチャンクを最大 size 個ずつ 1 つのプロンプトにまとめる
+		rest := make([]Chunk, len(pending))
+		for k, i := range pending {
+			rest[k] = funcs[i]
+		}
+		batched = map[int]batchReview{}
+		for k, b := range r.reviewBatches(ctx, path, ext, rest, size) {
+			batched[pending[k]] = b
+		}
+	}
+	var single []int // バッチにまとめず個別にレビューするチャンクの添字
+	for _, i := range pending {
+		if _, ok := batched[i]; !ok {
+			single = append(single, i)
+		}
+	}
+	reviews, wait := r.startReviews(ctx, path, ext, funcs, single)
+	defer wait()
+	for i, fn := range funcs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if e, ok := resumed[i]; ok {
+			r.resumed++
+			r.langStats(chunkLang(ext, fn)).chunks++
+			r.findings += e.Findings
+			r.addIssues(e.Issues)
+			if e.Clean != "" {
+				r.clean = append(r.clean, e.Clean)
+			}
+			r.report = append(r.report, e.Section)
+			continue
+		}
+		var res reviewResult
+		var model string
+		var err error
+		if b, ok := batched[i]; ok {
+			res, model = b.res, b.model
+		} else {
+			// ワーカーによるレビューの完了を元の順序どおりに待つ
+			c := reviews[i]
+			select {
+			case <-c.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			res, model, err = c.res, c.model, c.err
+		}
+		var tooLarge *PromptTooLargeError
+		if errors.As(err, &tooLarge) {
+			log.Printf("Skipping %s[%s]: %v", path, fn.Name, err)
+			r.oversized++
+			continue
+		}
+		if err != nil {
+			log.Printf("Review error %s[%d]: %v", path, i+1, err)
+			r.failed++
+			continue
+		}
+		r.reviewed++
+		r.langStats(chunkLang(ext, fn)).chunks++
+		r.addUsage(model, res)
+		entry := stateEntry{ID: r.stateKey + "/" + ids[i]}
+		if delim := viper.GetString("finding_delimiter"); delim != "" {
+			found := splitFindings(res.Raw, delim)
+			entry.Findings = len(found)
+			entry.Issues = issueTitles(found, delim)
+			r.findings += entry.Findings
+			r.addIssues(entry.Issues)
+			if entry.Findings == 0 {
+				// 指摘なしのチャンクは読み飛ばしと区別できるよう一覧に残す
+				entry.Clean = fmt.Sprintf("%s - %s", r.reportPath(path), chunkLabel(fn, i, len(funcs)))
+				r.clean = append(r.clean, entry.Clean)
+			}
+		}
+		if fn.Stripped {
+			r.stripped++
+		}
+		log.Printf("%s chunk %d/%d reviewed by %s", path, i+1, len(funcs), model)
+		log.Println(res.Raw)
+		if dir := viper.GetString("save_raw"); dir != "" {
+			if err := saveRaw(dir, r.root, path, i, fn, res.Raw); err != nil {
+				log.Printf("Save raw error %s[%d]: %v", path, i+1, err)
+			}
+		}
+		// チャンク ID をアンカーとして残し、行番号がずれても指摘を追跡できるようにする
+		entry.Section = fmt.Sprintf("<a id=\"chunk-%s\"></a>\n\n## %s - %s\n\n%s%s", ids[i], r.reportPath(path), chunkLabel(fn, i, len(funcs)), res.Markdown(), sectionEnd())
+		r.report = append(r.report, entry.Section)
+		if r.state != nil {
+			if err := r.state.record(entry); err != nil {
+				log.Printf("Write state_file error: %v", err)
+			}
+		}
+	}
+	for i, c := range pf.todos {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		res, err := r.reviewWithRetry(ctx, r.clientFor(r.model), r.model, r.todoGuideline, strings.TrimPrefix(ext, "."), c)
+		if err != nil {
+			log.Printf("Review error %s[todo %d]: %v", path, i+1, err)
+			r.failed++
+			continue
+		}
+		r.reviewed++
+		r.langStats(chunkLang(ext, c)).chunks++
+		r.addUsage(r.model, res)
+		log.Printf("%s todo %d/%d reviewed", path, i+1, len(pf.todos))
+		r.todoReport = append(r.todoReport, fmt.Sprintf("## %s - %s\n\n```%s\n%s\n```\n\n%s%s",
+			r.reportPath(path), chunkLabel(c, i, len(pf.todos)), strings.TrimPrefix(ext, "."), c.Code, res.Markdown(), sectionEnd()))
+	}
+	return nil
+}
+
+// chunkReview はワーカーによる 1 チャンクのレビュー結果。done が閉じられた
+// 時点で確定する。
+type chunkReview struct {
+	res   reviewResult
+	model string
+	err   error
+	done  chan struct{}
+}
+
+// startReviews は funcs のうち添字が indexes のチャンクを concurrency 個の
+// ワーカーで並行にレビューし始め、添字ごとの結果を返す。結果の集計は呼び出し側が
+// 元の順序どおりに行うため、レポートの順序はワーカー数によらない。返す関数は
+// すべてのワーカーの終了を待つ。
+func (r *reviewRun) startReviews(ctx context.Context, path, ext string, funcs []Chunk, indexes []int) (map[int]*chunkReview, func()) {
+	reviews := make(map[int]*chunkReview, len(indexes))
+	for _, i := range indexes {
+		reviews[i] = &chunkReview{done: make(chan struct{})}
+	}
+	workers := min(max(r.concurrency, 1), max(len(indexes), 1))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				c := reviews[i]
+				if c.err = ctx.Err(); c.err == nil {
+					c.res, c.model, c.err = r.reviewOne(ctx, path, ext, funcs, i, workers == 1)
+				}
+				close(c.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, i := range indexes {
+			jobs <- i
+		}
+	}()
+	return reviews, wg.Wait
+}
+
+// reviewFlights は進行中のレビューをチャンクのキーごとに保持し、同じチャンクを
+// 並行にレビューしようとしたワーカーに 1 回の要求の結果を共有させる。
+type reviewFlights struct {
+	mu    sync.Mutex
+	calls map[string]*chunkReview
+}
+
+// do は key のレビューが進行中ならその完了を待って結果を共有し、そうでなければ
+// fn を実行する。完了したレビューは保持しないため、以後の同じ key は改めて
+// レビューする。共有した結果のトークン数は要求した側だけが計上するよう 0 にする。
+// nil の場合は常に fn を実行する。
+func (g *reviewFlights) do(key string, fn func() (reviewResult, string, error)) (reviewResult, string, error) {
+	if g == nil {
+		return fn()
+	}
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		res := c.res
+		res.PromptTokens, res.OutputTokens, res.byModel = 0, 0, nil
+		return res, c.model, c.err
+	}
+	c := &chunkReview{done: make(chan struct{})}
+	if g.calls == nil {
+		g.calls = map[string]*chunkReview{}
+	}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.res, c.model, c.err = fn()
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(c.done)
+	return c.res, c.model, c.err
+}
+
+// reviewOne は funcs[i] をレビューし、結果とレビューしたモデルを返す。
+// spin が true なら進捗をスピナーで表示する。並行にレビューする場合は表示が
+// 混ざるためスピナーを使わない。
+func (r *reviewRun) reviewOne(ctx context.Context, path, ext string, funcs []Chunk, i int, spin bool) (reviewResult, string, error) {
+	// 同じチャンクがすでにレビュー中なら要求を重ねずにその結果を使う
+	return r.flights.do(chunkID(r.root, path, funcs[i]), func() (reviewResult, string, error) {
+		return r.reviewChunkAt(ctx, path, ext, funcs, i, spin)
+	})
+}
+
+// reviewChunkAt は reviewOne の本体で、funcs[i] を実際にモデルへ送ってレビューする。
+func (r *reviewRun) reviewChunkAt(ctx context.Context, path, ext string, funcs []Chunk, i int, spin bool) (reviewResult, string, error) {
+	fn := funcs[i]
+	if viper.GetBool("include_blame") && gitAvailable() {
+		// 直近の変更者とコミットをテンプレートの blame として渡す。min_churn や
+		// パッチ・再開による絞り込みの後、実際にレビューするチャンクだけで実行する
+		fn.Blame = blameSummary(path, fn.StartLine, fn.EndLine)
+	}
+	if spin {
+		// 進捗表示はログと同じ標準エラーへ出し、標準出力へのレポートと混ざらないようにする
+		sp := spinner.New(spinner.CharSets[14], 100*time.Millisecond, spinner.WithWriterFile(os.Stderr))
+		sp.Suffix = fmt.Sprintf(" %s[%s] chunk %d/%d reviewing...", path, fn.Name, i+1, len(funcs))
+		sp.Start()
+		defer sp.Stop()
+	}
+	if models := viper.GetStringSlice("compare_models"); len(models) > 0 {
+		// 比較用の各モデルで同じチャンクをレビューし、並べて載せる
+		res, err := r.compareReview(ctx, models, chunkLang(ext, fn), fn)
+		return res, strings.Join(models, ", "), err
+	}
+	route := selectRoute(r.routes, r.model, ext, len(fn.Code))
+	res, err := r.reviewWithRetry(ctx, r.routeClient(route), route.Model, r.guideline, chunkLang(ext, fn), fn)
+	return res, route.Model, err
+}
+
+// processFiles は paths を parse_workers 個のワーカーで並行に読み込み・抽出し、
+// 元の順序どおりにレビューする。先読みはワーカー数までに制限される。
+// prepared は paths の先頭から順に prepareFile 済みの結果で、それらのファイルは
+// 読み込み・抽出をやり直さない。
+func (r *reviewRun) processFiles(ctx context.Context, paths []string, prepared []*parsedFile) error {
+	workers := parseWorkers()
+	// 中断で戻るときも先読み中のワーカーの終了を待ち、戻った後に設定や
+	// ファイルへ触れないようにする。cancel が先に実行されるよう先に defer する。
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		pf  *parsedFile
+		err error
+	}
+	rest := paths[len(prepared):]
+	results := make([]chan result, len(rest))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	sem := make(chan struct{}, workers)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, p := range rest {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pf, err := prepareFile(p, nil)
+				results[i] <- result{pf, err}
+			}()
+		}
+	}()
+
+	for i := range paths {
+		var res result
+		if i < len(prepared) {
+			res.pf = prepared[i]
+		} else {
+			select {
+			case res = <-results[i-len(prepared)]:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			<-sem // 消費したぶん次のファイルの先読みを許可する
+		}
+		if res.err != nil {
+			return res.err
+		}
+		if res.pf == nil {
+			continue
+		}
+		if res.pf.skip != "" {
+			r.countSkip(res.pf.skip)
+			continue
+		}
+		if r.changed != nil {
+			// パッチの変更行に重なる関数だけをレビューする
+			res.pf.funcs = overlapping(res.pf.funcs, r.changed[res.pf.path])
+			res.pf.todos = overlapping(res.pf.todos, r.changed[res.pf.path])
+			if len(res.pf.funcs) == 0 && len(res.pf.todos) == 0 {
+				continue
+			}
+		}
+		if err := r.reviewFile(ctx, res.pf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxAutoWorkers は parse_workers: auto で選ぶワーカー数の上限。
+const maxAutoWorkers = 8
+
+// parseWorkers は parse_workers の設定からワーカー数を決める。"auto" の場合は
+// CPU 数を基に maxAutoWorkers までの値を選ぶ。明示した数値はそのまま使う。
+func parseWorkers() int {
+	if strings.EqualFold(viper.GetString("parse_workers"), "auto") {
+		n := min(runtime.NumCPU(), maxAutoWorkers)
+		log.Printf("parse_workers: auto resolved to %d", n)
+		return n
+	}
+	return max(viper.GetInt("parse_workers"), 1)
+}
+
+// defaultSuppressMarker は suppress_marker 未指定時の抑止コメントの目印。
+const defaultSuppressMarker = "ollama-review: ignore"
+
+// splitSuppressed は関数の先頭行、またはその直前のコメントだけの行に
+// 抑止コメントの目印を含む関数を取り除き、残りの関数と取り除いた関数を返す。
+func splitSuppressed(src []byte, funcs []Chunk) (kept, suppressed []Chunk) {
+	marker := defaultSuppressMarker
+	if viper.IsSet("suppress_marker") {
+		marker = viper.GetString("suppress_marker")
+	}
+	if marker == "" || !bytes.Contains(src, []byte(marker)) {
+		return funcs, nil
+	}
+	lines := strings.Split(string(src), "\n")
+	marked := func(line int) bool {
+		return line >= 1 && line <= len(lines) && strings.Contains(lines[line-1], marker)
+	}
+	for _, fn := range funcs {
+		above := fn.StartLine - 1
+		if marked(fn.StartLine) || (marked(above) && isCommentLine(lines[above-1])) {
+			suppressed = append(suppressed, fn)
+			continue
+		}
+		kept = append(kept, fn)
+	}
+	return kept, suppressed
+}
+
+// isCommentLine は行がコメントだけで構成されているかを簡易的に判定する。
+func isCommentLine(line string) bool {
+	t := strings.TrimSpace(line)
+	for _, p := range []string{"//", "#", "/*", "*"} {
+		if strings.HasPrefix(t, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// wholeRepoMarkerFormat はリポジトリ全体をまとめたプロンプトで各ファイルの
+// 先頭に置く区切り行。
+const wholeRepoMarkerFormat = "=== file: %s ==="
+
+// reviewWholeRepo は prepareFile で抽出・フィルタした関数の合計サイズが limit
+// バイト未満であれば、ファイルごとに区切り行を付けて連結し 1 回の要求で
+// レビューする。関数単位のレビューと同じく max_file_bytes・バイナリ・空ファイル・
+// exclude_func_regex・インライン抑止・exported_only などが適用され、言語の判定も
+// 同じ規則に従う。TODO/FIXME コメントのレビューは行わない。まとめてレビューした
+// 場合は true を返す。合計が limit 以上の場合や、プロンプトが上限を超える場合は
+// false と paths の先頭から prepareFile 済みの結果を返し、関数単位のレビューに
+// 任せる。関数単位のレビューではそれらを解析し直さずに使う。
+func (r *reviewRun) reviewWholeRepo(ctx context.Context, paths []string, limit int64) (bool, []*parsedFile, error) {
+	var prepared, files []*parsedFile
+	var total int64
+	langs := map[string]struct{}{}
+	for _, p := range paths {
+		if ctx.Err() != nil {
+			return true, nil, ctx.Err()
+		}
+		pf, err := prepareFile(p, nil)
+		if err != nil {
+			return true, nil, err
+		}
+		prepared = append(prepared, pf)
+		if pf == nil {
+			continue
+		}
+		for _, fn := range pf.funcs {
+			total += int64(len(fn.Code))
+			langs[chunkLang(pf.ext, fn)] = struct{}{}
+		}
+		if total >= limit {
+			return false, prepared, nil
+		}
+		files = append(files, pf)
+	}
+	var parts []string
+	for _, pf := range files {
+		if len(pf.funcs) == 0 {
+			continue
+		}
+		codes := make([]string, len(pf.funcs))
+		for i, fn := range pf.funcs {
+			codes[i] = string(fn.Code)
+		}
+		parts = append(parts, fmt.Sprintf(wholeRepoMarkerFormat, r.reportPath(pf.path))+"\n"+strings.Join(codes, "\n\n"))
+	}
+	if len(parts) == 0 {
+		return false, prepared, nil
+	}
+	lang := "multi-language"
+	if len(langs) == 1 {
+		for l := range langs {
+			lang = l
+		}
+	}
+	fn := Chunk{Name: "whole repository", Code: []byte(strings.Join(parts, "\n\n"))}
+	log.Printf("Reviewing %d files (%d bytes) as a single prompt", len(parts), total)
+	res, err := r.reviewWithRetry(ctx, r.clientFor(r.model), r.model, r.guideline, lang, fn)
+	var tooLarge *PromptTooLargeError
+	if errors.As(err, &tooLarge) {
+		log.Printf("Whole-repository prompt skipped: %v; reviewing per function", err)
+		return false, prepared, nil
+	}
+	if err != nil {
+		if isInterrupted(err) {
+			return true, nil, err
+		}
+		log.Printf("Whole-repository review error: %v; reviewing per function", err)
+		return false, prepared, nil
+	}
+	// 関数単位のレビューと同じく読み飛ばし・抑止・言語ごとの件数を集計する
+	for _, pf := range files {
+		if pf.skip != "" {
+			r.countSkip(pf.skip)
+			continue
+		}
+		for _, c := range pf.suppressed {
+			r.suppressed = append(r.suppressed, fmt.Sprintf("%s - %s", r.reportPath(pf.path), chunkLabel(c, 0, 1)))
+		}
+		if len(pf.funcs) == 0 {
+			continue
+		}
+		if pf.partial {
+			r.partialFiles++
+		}
+		r.countFiles(pf.ext, pf.funcs, nil)
+		for _, fn := range pf.funcs {
+			r.langStats(chunkLang(pf.ext, fn)).chunks++
+		}
+	}
+	r.reviewed++
+	r.addUsage(r.model, res)
+	r.report = append(r.report, fmt.Sprintf("## %s (%d files)\n\n%s%s", fn.Name, len(parts), res.Markdown(), sectionEnd()))
+	return true, nil, nil
+}
+
+// excludeFuncsByName は exclude_func_regex のいずれかに名前が一致する関数を
+// 取り除く。モック生成など自動生成された関数を個別に除外するために用いる。
+func excludeFuncsByName(funcs []Chunk) ([]Chunk, error) {
+	patterns := viper.GetStringSlice("exclude_func_regex")
+	if len(patterns) == 0 {
+		return funcs, nil
+	}
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("exclude_func_regex %q: %w", p, err)
+		}
+		res = append(res, re)
+	}
+	kept := funcs[:0]
+next:
+	for _, fn := range funcs {
+		for _, re := range res {
+			if re.MatchString(fn.Name) {
+				continue next
+			}
+		}
+		kept = append(kept, fn)
+	}
+	return kept, nil
+}
+
+// addNeighbors は各関数に前後 n 個までの関数シグネチャを設定する。
+// 本体は含めず、近傍の関数との関係を安価にモデルへ伝えるために用いる。
+func addNeighbors(funcs []Chunk, n int) {
+	for i := range funcs {
+		var b strings.Builder
+		for j := max(0, i-n); j < i; j++ {
+			fmt.Fprintf(&b, "before: %s\n", chunkSignature(funcs[j]))
+		}
+		for j := i + 1; j < len(funcs) && j <= i+n; j++ {
+			fmt.Fprintf(&b, "after: %s\n", chunkSignature(funcs[j]))
+		}
+		funcs[i].Neighbors = b.String()
+	}
+}
+
+// chunkSignature は近傍の文脈に使うチャンクのシグネチャを返す。抽出時に
+// 定義ノードから求めたものがなければ Code の先頭行を用いる。
+func chunkSignature(fn Chunk) string {
+	if fn.sig != "" {
+		return fn.sig
+	}
+	return signature(fn.Code)
+}
+
+// annotationNodeTypes は Java の注釈ノードの種類。
+var annotationNodeTypes = map[string]struct{}{
+	"annotation":        {},
+	"marker_annotation": {},
+}
+
+// signatureStart は関数ノード n のシグネチャの開始位置を返す。Java の
+// 修飾子に含まれる注釈は飛ばし、最初の修飾子キーワードか、注釈しかなければ
+// 修飾子の次の要素から始める。
+func signatureStart(n *sitter.Node) uint32 {
+	for i := 0; i < int(n.ChildCount()); i++ {
+		c := n.Child(i)
+		if c.Type() != "modifiers" {
+			continue
+		}
+		for j := 0; j < int(c.ChildCount()); j++ {
+			if _, ok := annotationNodeTypes[c.Child(j).Type()]; !ok {
+				return c.Child(j).StartByte()
+			}
+		}
+		if i+1 < int(n.ChildCount()) {
+			return n.Child(i + 1).StartByte()
+		}
+	}
+	return n.StartByte()
+}
+
+// signature は関数コードの先頭行から本体の開始記号を除いたものを返す。
+func signature(code []byte) string {
+	line, _, _ := strings.Cut(string(code), "\n")
+	line = strings.TrimSpace(line)
+	return strings.TrimSpace(strings.TrimSuffix(line, "{"))
+}
+
+// rawNameReplacer はファイル名に使えない文字を置き換える。
+var rawNameReplacer = strings.NewReplacer("/", "_", "\\", "_", ":", "_", "<", "_", ">", "_", " ", "_")
+
+// saveRaw はモデルの生の応答を dir 配下へ「ファイル名.チャンク番号.関数名.txt」
+// として書き出す。プロンプト調整時のデバッグ用。
+func saveRaw(dir, root, path string, i int, fn Chunk, raw string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		rel = filepath.Base(path)
+	}
+	name := fmt.Sprintf("%s.%03d.%s.txt", rawNameReplacer.Replace(filepath.ToSlash(rel)), i+1, rawNameReplacer.Replace(fn.Name))
+	return os.WriteFile(filepath.Join(dir, name), []byte(raw), 0644)
+}
+
+// chunkLang はプロンプトに渡す言語キーを返す。チャンク自身に言語が
+// 指定されていればファイルの拡張子より優先する。
+func chunkLang(ext string, fn Chunk) string {
+	if fn.Lang != "" {
+		return fn.Lang
+	}
+	return strings.TrimPrefix(ext, ".")
+}
+
+// chunkLabel は見出しに使うチャンクの表記を返す。同名の関数（オーバーロード等）
+// を区別できるよう、行範囲が分かる場合は関数名に行範囲を添える。
+func chunkLabel(fn Chunk, i, total int) string {
+	if fn.StartLine > 0 {
+		return fmt.Sprintf("%s (lines %d-%d, chunk %d/%d)", fn.Name, fn.StartLine, fn.EndLine, i+1, total)
+	}
+	return fmt.Sprintf("%s (chunk %d/%d)", fn.Name, i+1, total)
+}
+
+// languageSelected は languages 設定（--lang py,go）で対象言語が絞り込まれている
+// 場合に、拡張子 ext の言語キーが含まれるかを判定する。未指定時は常に true。
+func languageSelected(ext string) bool {
+	langs := viper.GetStringSlice("languages")
+	if len(langs) == 0 {
+		return true
+	}
+	key := strings.TrimPrefix(ext, ".")
+	for _, l := range langs {
+		if strings.TrimPrefix(strings.TrimSpace(l), ".") == key {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlankSource は src が空、空白のみ、またはコメントのみで構成されているかを
+// 判定する。Python は "#"、それ以外は "//" と "/* */" を行単位で簡易的に扱う。
+func isBlankSource(src []byte, ext string) bool {
+	inBlock := false
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		for line != "" {
+			if inBlock {
+				end := strings.Index(line, "*/")
+				if end < 0 {
+					line = ""
+					break
+				}
+				inBlock = false
+				line = strings.TrimSpace(line[end+2:])
+				continue
+			}
+			if ext == ".py" {
+				if strings.HasPrefix(line, "#") {
+					line = ""
+					break
+				}
+				return false
+			}
+			switch {
+			case strings.HasPrefix(line, "//"):
+				line = ""
+			case strings.HasPrefix(line, "/*"):
+				inBlock = true
+				line = line[2:]
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// anonymizedRoot は anonymize_paths 有効時にリポジトリルートの代わりに
+// レポートへ記載するプレースホルダ。
+const anonymizedRoot = "<repo>"
+
+// reportPath はレポートの見出しに記載するパスを返す。アーカイブを展開して
+// レビューしている場合は、一時ディレクトリの代わりにアーカイブ名を起点にする。
+func (r *reviewRun) reportPath(path string) string {
+	if r.archive == "" || viper.GetBool("anonymize_paths") {
+		return reportPath(r.root, path)
+	}
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.Base(r.archive) + "/" + filepath.ToSlash(rel)
+}
+
+// reportPath はレポートの見出しに記載するパスを返す。anonymize_paths が有効な
+// 場合はリポジトリルートをプレースホルダに置き換え、絶対パスを漏らさない。
+func reportPath(root, path string) string {
+	if !viper.GetBool("anonymize_paths") {
+		return path
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return anonymizedRoot + "/" + filepath.Base(path)
+	}
+	if rel == "." {
+		// 単一ファイル指定時はファイル名のみを残す
+		rel = filepath.Base(path)
+	}
+	return anonymizedRoot + "/" + filepath.ToSlash(rel)
+}
+
+// defaultExcludeDirs は既定で探索から除外するベンダリング・依存ディレクトリ。
+var defaultExcludeDirs = []string{
+	"vendor",
+	"node_modules",
+	"third_party",
+	".venv",
+	"venv",
+	".git",
+}
+
+// isExcludedDir はディレクトリ名または repoRoot からの相対パスが除外指定に
+// 一致するかを判定する。
+func isExcludedDir(repoRoot, path, name string, ignoreDirs map[string]struct{}) bool {
+	if _, ok := ignoreDirs[name]; ok {
+		return true
+	}
+	rel, err := filepath.Rel(repoRoot, path)
+	if err != nil {
+		return false
+	}
+	_, ok := ignoreDirs[filepath.ToSlash(rel)]
+	return ok
+}
+
+// dirDepth は root から見たディレクトリ path の階層の深さを返す。
+// root 自身は 0、その直下のディレクトリは 1。
+func dirDepth(root, path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return 0
+	}
+	return len(strings.Split(filepath.ToSlash(rel), "/"))
+}
+
+// isReviewIgnored は path が .reviewignore のルールに一致するかを判定する。
+func isReviewIgnored(m *ignoreMatcher, repoRoot, path string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	rel, err := filepath.Rel(repoRoot, path)
+	if err != nil {
+		return false
+	}
+	return m.Match(rel, isDir)
+}
+
+// isInterrupted はシグナルによる中断または run_timeout の期限切れかを判定する。
+// いずれの場合もそこまでの結果を部分的なレポートとして書き出す。
+func isInterrupted(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// newReviewRun は設定からモデル・ガイドライン・クライアントなどを準備し、
+// root を起点とするレビュー実行を生成する。
+func newReviewRun(root string) (*reviewRun, error) {
+	if err := validateTruncation(); err != nil {
+		return nil, err
+	}
+	if err := validateReportSplit(); err != nil {
+		return nil, err
+	}
+	// ガイドラインテンプレートは実行開始時に一度だけ読み込む
+	guideline, err := loadGuideline("guideline", viper.GetStringSlice("guideline_partials"))
+	if err != nil {
+		return nil, err
+	}
+	hash, err := guidelineHash("guideline", viper.GetStringSlice("guideline_partials"))
+	if err != nil {
+		return nil, err
+	}
+	client, err := newOllamaClient()
+	if err != nil {
+		return nil, err
+	}
+	routes, err := loadModelRoutes()
+	if err != nil {
+		return nil, err
+	}
+	if err := connectRoutes(routes); err != nil {
+		return nil, err
+	}
+	// 使用するモデル名を設定ファイルから取得
+	run := &reviewRun{client: client, root: root, model: viper.GetString("model"), guideline: guideline, routes: routes, guidelineHash: hash, stateKey: resumeKey(hash), todoGuideline: guideline, budget: &retryBudget{left: -1}, flights: &reviewFlights{}}
+	if run.concurrency, err = resolveConcurrency(context.Background(), run.clientFor(run.model), run.model); err != nil {
+		return nil, err
+	}
+	run.seed = resolveSeed() // 再現性のための乱数シード
+	run.options = chatOptions(&run.seed)
+	if viper.IsSet("total_retry_budget") {
+		run.budget.left = viper.GetInt("total_retry_budget")
+	}
+	if viper.GetString("todo_guideline") != "" {
+		// TODO/FIXME コメント専用のガイドラインがあればそちらを使う
+		if run.todoGuideline, err = loadGuideline("todo_guideline", viper.GetStringSlice("guideline_partials")); err != nil {
+			return nil, err
+		}
+	}
+	return run, nil
+}
+
+// walkFilter はリポジトリ探索時に除外するディレクトリ・ファイルを判定する。
+type walkFilter struct {
+	root         string
+	ignoreDirs   map[string]struct{}
+	reviewIgnore *ignoreMatcher
+	// submodules は review_submodules が false のときに読み飛ばすサブモジュールの
+	// パス。nil ならサブモジュールも通常のディレクトリとして探索する。
+	submodules map[string]struct{}
+	// output はレポートの出力先の絶対パス。レポート自体と max_report_bytes で
+	// 分割したファイルをレビューしないよう除外する。標準出力へ書く場合は空文字。
+	output   string
+	maxDepth int // max_depth。これより深いディレクトリは探索しない（0 なら無制限）
+}
+
+// newWalkFilter は exclude 設定と root 直下の .reviewignore から探索フィルタを作る。
+func newWalkFilter(root string) (*walkFilter, error) {
+	// 除外ディレクトリをマップ化して高速に判定
+	// ディレクトリ名、または root からの相対パスで指定できる
+	// use_default_excludes が false でなければ既定の除外ディレクトリも加える
+	ignoreDirs := map[string]struct{}{}
+	excludes := viper.GetStringSlice("exclude")
+	if !viper.IsSet("use_default_excludes") || viper.GetBool("use_default_excludes") {
+		excludes = append(excludes, defaultExcludeDirs...)
+	}
+	for _, n := range excludes {
+		ignoreDirs[filepath.ToSlash(filepath.Clean(n))] = struct{}{}
+	}
+	// リポジトリ直下の .reviewignore（gitignore 形式）を読み込む
+	reviewIgnore, err := loadIgnoreFile(filepath.Join(root, ".reviewignore"))
+	if err != nil {
+		return nil, fmt.Errorf("read .reviewignore: %w", err)
+	}
+	f := &walkFilter{root: root, ignoreDirs: ignoreDirs, reviewIgnore: reviewIgnore, maxDepth: viper.GetInt("max_depth")}
+	if !viper.GetBool("review_submodules") {
+		if f.submodules, err = loadGitmodules(filepath.Join(root, ".gitmodules")); err != nil {
+			return nil, fmt.Errorf("read .gitmodules: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// skip は path（名前 name）を探索対象から外すべきかを判定する。
+func (f *walkFilter) skip(path, name string, isDir bool) bool {
+	if path == f.root {
+		// 探索の起点自体は除外対象にしない
+		return false
+	}
+	if isDir && isExcludedDir(f.root, path, name, f.ignoreDirs) {
+		return true
+	}
+	if isDir && f.submodules != nil && isSubmoduleDir(f.root, path, f.submodules) {
+		log.Printf("Skipping submodule %s", path)
+		return true
+	}
+	return isReviewIgnored(f.reviewIgnore, f.root, path, isDir)
+}
+
+// skipDir は探索中のディレクトリ path（名前 name）の中へ入るべきでないかを
+// 判定する。除外設定に加えて max_depth より深いディレクトリも除外する。
+func (f *walkFilter) skipDir(path, name string) bool {
+	if f.skip(path, name, true) {
+		return true
+	}
+	if f.maxDepth > 0 && dirDepth(f.root, path) > f.maxDepth {
+		// 深すぎるディレクトリ（入れ子の vendored ツリーなど）は探索しない
+		log.Printf("Skipping %s: deeper than max_depth %d", path, f.maxDepth)
+		return true
+	}
+	return false
+}
+
+// skipFile はファイル path をレビュー対象から外すべきかを判定する。除外設定に
+// 加えてレポートの出力先も除外する。
+func (f *walkFilter) skipFile(path string) bool {
+	if f.skip(path, filepath.Base(path), false) {
+		return true
+	}
+	if abs, _ := filepath.Abs(path); f.output != "" && isReportFile(abs, f.output) {
+		log.Printf("Skipping %s: report output file", path)
+		return true
+	}
+	return false
+}
+
+// save は集めたレビュー結果に TODO/FIXME 節・読み飛ばし統計・メタデータを
+// 加えてレポートを書き出す。
+func (r *reviewRun) save(outFile string, seed int) error {
+	sections := append([]string(nil), r.report...)
+	if len(r.todoReport) > 0 {
+		// TODO/FIXME コメントのレビューは専用の節としてまとめる
+		sections = append(sections, "# TODO / FIXME Review\n\n")
+		sections = append(sections, r.todoReport...)
+	}
+	if sec := r.topIssuesSection(); sec != "" {
+		sections = append(sections, sec)
+	}
+	if len(r.clean) > 0 {
+		sections = append(sections, "# Clean\n\n- "+strings.Join(r.clean, "\n- ")+"\n\n")
+	}
+	if len(r.suppressed) > 0 {
+		// 抑止したチャンクは見落としと区別できるよう一覧として残す
+		sections = append(sections, "# Suppressed\n\n- "+strings.Join(r.suppressed, "\n- ")+"\n\n")
+	}
+	if sec := r.languageSection(); sec != "" {
+		sections = append(sections, sec)
+	}
+	if sec := r.skippedSection(); sec != "" {
+		sections = append(sections, sec)
+	}
+	// まとめたレポートを Markdown ファイルへ出力
+	mode, err := outputFileMode()
+	if err != nil {
+		return err
+	}
+	meta := []string{
+		fmt.Sprintf("Seed: %d", seed),
+		fmt.Sprintf("Guideline: %s", r.guidelineHash),
+		fmt.Sprintf("Partially parsed files: %d", r.partialFiles),
+	}
+	if r.stripped > 0 {
+		meta = append(meta, fmt.Sprintf("Comments stripped before review: %d chunks", r.stripped))
+	}
+	if r.resumed > 0 {
+		meta = append(meta, fmt.Sprintf("Resumed from state_file: %d chunks", r.resumed))
+	}
+	if viper.GetString("finding_delimiter") != "" {
+		meta = append(meta, fmt.Sprintf("Findings: %d", r.findings))
+	}
+	meta = append(meta, r.costLines()...)
+	if err := writeReport(outFile, meta, sections, viper.GetBool("append"), mode); err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
+	return nil
+}
+
+// Review はリポジトリ内を探索し、各ファイルの関数単位で AI にレビューを
+// 依頼するメイン関数。取得した結果は Markdown として保存される。
+func Review(ctx context.Context, repoRoot string, outFile string) error {
+	log.Printf("Start review: repo=%s", repoRoot)
+
+	repoRoot, lines, err := parseSourceSpec(repoRoot)
+	if err != nil {
+		return err
+	}
+	var archive string
+	if lines == nil && isArchive(repoRoot) {
+		// zip / tar.gz は一時ディレクトリへ展開し、ディレクトリと同様にレビューする
+		dir, err := extractArchive(repoRoot)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		archive, repoRoot = repoRoot, dir
+	}
+	run, err := newReviewRun(repoRoot)
+	if err != nil {
+		return err
+	}
+	run.archive = archive
+	if p := viper.GetString("state_file"); p != "" {
+		// 完了したチャンクを記録し、--resume 時は記録済みのチャンクを読み飛ばす
+		if run.state, err = openRunState(p, viper.GetBool("resume")); err != nil {
+			return err
+		}
+		defer run.state.Close()
+	}
+	info, err := os.Stat(repoRoot)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && lines != nil {
+		return fmt.Errorf("line range requires a single source file: %s", repoRoot)
+	}
+	if info.IsDir() {
+		filter, err := newWalkFilter(repoRoot)
+		if err != nil {
+			return err
+		}
+		// レポート自体をレビュー対象に含めないよう出力先のファイルは除外する
+		if outFile != stdoutPath {
+			filter.output, _ = filepath.Abs(outFile)
+		}
+		var paths []string
+		walkFn := func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// パーミッションエラー等が発生した場合はそのまま返す
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if d.IsDir() {
+				if filter.skipDir(path, d.Name()) {
+					// 指定されたディレクトリは探索しない
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if !filter.skipFile(path) {
+				paths = append(paths, path)
+			}
+			return nil
+		}
+		if p := viper.GetString("patch"); p != "" {
+			// diff ファイルに含まれるファイルの変更箇所だけをレビューする
+			if paths, err = run.patchPaths(p, filter); err != nil {
+				return err
+			}
+		} else if base := viper.GetString("diff"); base != "" {
+			// 基準ブランチとの差分に含まれる変更箇所だけをレビューする
+			if paths, err = run.diffPaths(base, filter); err != nil {
+				return err
+			}
+		} else if err := filepath.WalkDir(repoRoot, walkFn); err != nil && !isInterrupted(err) {
+			// 探索で対象ファイルを集めてから、解析とレビューを行う
+			return err
+		}
+		whole := false
+		var prepared []*parsedFile
+		if limit := viper.GetInt64("small_repo_threshold"); limit > 0 && run.changed == nil {
+			// 小さなリポジトリは全体を 1 つのプロンプトにまとめて俯瞰的にレビューする
+			if whole, prepared, err = run.reviewWholeRepo(ctx, paths, limit); err != nil && !isInterrupted(err) {
+				return err
+			}
+		}
+		if !whole {
+			if err := run.processFiles(ctx, paths, prepared); err != nil && !isInterrupted(err) {
+				return err
+			}
+		}
+	} else {
+		if err := run.processFile(ctx, repoRoot, lines); err != nil && !isInterrupted(err) {
+			return err
+		}
+	}
+	if err := run.save(outFile, run.seed); err != nil {
+		return err
 	}
 
-	log.Printf("Report saved: %s", outFile)
+	if outFile != stdoutPath {
+		log.Printf("Report saved: %s", outFile)
+	}
 	log.Printf("Review completed: %s", outFile)
+	run.writeSummary(outFile)
 	return ctx.Err()
 }
+
+// stdoutPath は出力先として標準出力を表す特別なパス。
+const stdoutPath = "-"
+
+// writeReport はレポートを outFile へ書き出す。outFile が "-" の場合は標準出力へ書く。appendMode が有効で既存ファイルが
+// ある場合は、上書きせず日時付きのセクションとして末尾に追記する。
+// 出力先ディレクトリが存在しない場合は作成する。meta は見出し直下に
+// 箇条書きで出力する実行メタデータ。
+func writeReport(outFile string, meta, report []string, appendMode bool, mode os.FileMode) error {
+	body := normalizeMarkdown(renderMeta(meta) + strings.Join(report, ""))
+	if outFile == stdoutPath {
+		// パイプ用途では標準出力へ書き出し、ファイルは作成しない
+		_, err := io.WriteString(os.Stdout, "# Code Review Report\n\n"+body)
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(outFile), 0755); err != nil {
+		return err
+	}
+	if limit := viper.GetInt("max_report_bytes"); limit > 0 && !appendMode {
+		return writeReportParts(outFile, meta, report, limit, mode)
+	}
+	if appendMode {
+		if _, err := os.Stat(outFile); err == nil {
+			f, err := os.OpenFile(outFile, os.O_APPEND|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+			header := "\n# Code Review Report\n\n"
+			if !viper.GetBool("deterministic") {
+				header = fmt.Sprintf("\n# Code Review Report (%s)\n\n", time.Now().Format(time.RFC3339))
+			}
+			if _, err := f.WriteString(header + body); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		}
+	}
+	return os.WriteFile(outFile, []byte("# Code Review Report\n\n"+body), mode)
+}
+
+// validateReportSplit は max_report_bytes と append の併用を検証する。追記した
+// レポートは分割できないため、両方が指定された場合は誤りとして扱う。
+func validateReportSplit() error {
+	if viper.GetInt("max_report_bytes") > 0 && viper.GetBool("append") {
+		return fmt.Errorf("max_report_bytes cannot be combined with append")
+	}
+	return nil
+}
+
+// reportPartPath は分割したレポートの n 番目（1 始まり）のファイル名を返す。
+// 1 番目は outFile そのもので、以降は report.part2.md のように番号を付ける。
+func reportPartPath(outFile string, n int) string {
+	if n == 1 {
+		return outFile
+	}
+	ext := filepath.Ext(outFile)
+	return fmt.Sprintf("%s.part%d%s", strings.TrimSuffix(outFile, ext), n, ext)
+}
+
+// isReportFile は path がレポート outFile そのもの、または分割したレポートの
+// report.part2.md のようなファイルかを返す。
+func isReportFile(path, outFile string) bool {
+	if path == outFile {
+		return true
+	}
+	ext := filepath.Ext(outFile)
+	rest, ok := strings.CutPrefix(path, strings.TrimSuffix(outFile, ext)+".part")
+	if !ok || !strings.HasSuffix(rest, ext) {
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(rest, ext))
+	return err == nil && n >= 2
+}
+
+// writeReportParts は max_report_bytes を超えないよう節の境界でレポートを
+// 複数ファイルへ分けて書き出し、各ファイルに前後へのリンクを付ける。1 節だけで
+// 上限を超える場合はその節を単独のファイルにする。以前の実行で残った余分な
+// 分割ファイルは削除する。
+func writeReportParts(outFile string, meta, report []string, limit int, mode os.FileMode) error {
+	var parts []string
+	cur := renderMeta(meta)
+	for _, sec := range report {
+		if cur != "" && len(cur)+len(sec) > limit {
+			parts = append(parts, cur)
+			cur = ""
+		}
+		cur += sec
+	}
+	parts = append(parts, cur)
+
+	for i, body := range parts {
+		n := i + 1
+		var nav []string
+		if n > 1 {
+			nav = append(nav, fmt.Sprintf("[Previous](%s)", filepath.Base(reportPartPath(outFile, n-1))))
+		}
+		if n < len(parts) {
+			nav = append(nav, fmt.Sprintf("[Next](%s)", filepath.Base(reportPartPath(outFile, n+1))))
+		}
+		header := "# Code Review Report\n\n"
+		if n > 1 {
+			header = fmt.Sprintf("# Code Review Report (part %d/%d)\n\n", n, len(parts))
+		}
+		links := ""
+		if len(nav) > 0 {
+			links = strings.Join(nav, " | ") + "\n\n"
+		}
+		content := normalizeMarkdown(header + links + body + "\n\n" + links)
+		if err := os.WriteFile(reportPartPath(outFile, n), []byte(content), mode); err != nil {
+			return err
+		}
+	}
+	ext := filepath.Ext(outFile)
+	stale, _ := filepath.Glob(strings.TrimSuffix(outFile, ext) + ".part*" + ext)
+	for _, p := range stale {
+		if !isReportFile(p, outFile) {
+			continue
+		}
+		n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(p, strings.TrimSuffix(outFile, ext)+".part"), ext))
+		if n > len(parts) {
+			os.Remove(p)
+		}
+	}
+	return nil
+}
+
+// defaultSectionSeparator は section_separator 未指定時の節の区切り行。
+const defaultSectionSeparator = "---"
+
+// sectionEnd は各節の末尾に付ける区切りを返す。section_separator に空文字を
+// 指定すると区切り行を置かず、空行だけで節を区切る。
+func sectionEnd() string {
+	sep := defaultSectionSeparator
+	if viper.IsSet("section_separator") {
+		sep = strings.TrimSpace(viper.GetString("section_separator"))
+	}
+	if sep == "" {
+		return "\n\n"
+	}
+	return "\n\n" + sep + "\n\n"
+}
+
+// normalizeMarkdown は Markdown の一般的な lint 規則に合うよう、行末の空白を
+// 取り除き、連続する空行を 1 行にまとめ、末尾を改行 1 つでそろえる。
+// フェンスドコードブロック（``` / ~~~）の中はコードをそのまま残すため変更しない。
+func normalizeMarkdown(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return ""
+	}
+	var out []string
+	fence := ""   // 開いているフェンス（空なら外側）
+	blank := true // 直前の出力行が空行か（先頭の空行も取り除く）
+	for _, l := range strings.Split(s, "\n") {
+		if fence != "" {
+			out = append(out, l)
+			if f := fenceMarker(l); f != "" && strings.HasPrefix(f, fence[:1]) && len(f) >= len(fence) && strings.TrimSpace(l) == f {
+				fence = ""
+				blank = false
+			}
+			continue
+		}
+		l = strings.TrimRight(l, " \t")
+		if l == "" {
+			if !blank {
+				out = append(out, l)
+			}
+			blank = true
+			continue
+		}
+		fence = fenceMarker(l)
+		out = append(out, l)
+		blank = false
+	}
+	return strings.TrimRight(strings.Join(out, "\n"), "\n") + "\n"
+}
+
+// fenceMarker は line がフェンスドコードブロックの区切り行であれば、先頭の
+// ``` や ~~~ の連なりを返す。区切り行でなければ空文字を返す。
+func fenceMarker(line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 || len(trimmed) < 3 {
+		return ""
+	}
+	c := trimmed[0]
+	if c != '`' && c != '~' {
+		return ""
+	}
+	n := 0
+	for n < len(trimmed) && trimmed[n] == c {
+		n++
+	}
+	if n < 3 {
+		return ""
+	}
+	return trimmed[:n]
+}
+
+// renderMeta はメタデータを Markdown の箇条書きとして整形する。
+func renderMeta(meta []string) string {
+	if len(meta) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for _, m := range meta {
+		b.WriteString("- " + m + "\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// resolveSeed は設定された seed を返す。未指定の場合は乱数で決定し、後から
+// 同じレビューを再現できるようログに残す。deterministic モードで未指定の場合は
+// 固定値 0 を用いる。決めた値は設定へ書き戻さない。
+func resolveSeed() int {
+	if viper.IsSet("seed") {
+		return viper.GetInt("seed")
+	}
+	if viper.GetBool("deterministic") {
+		return 0
+	}
+	seed := rand.IntN(math.MaxInt32)
+	log.Printf("No seed configured; using random seed %d", seed)
+	return seed
+}
+
+// outputFileMode は output_mode_bits からレポートのファイルモードを求める。
+// 文字列は 8 進数（例: "0600"）として解釈し、未指定時は 0644 とする。
+func outputFileMode() (os.FileMode, error) {
+	switch v := viper.Get("output_mode_bits").(type) {
+	case nil:
+		return 0644, nil
+	case string:
+		n, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return 0, fmt.Errorf("parse output_mode_bits %q: %w", v, err)
+		}
+		return os.FileMode(n).Perm(), nil
+	default:
+		return os.FileMode(viper.GetUint32("output_mode_bits")).Perm(), nil
+	}
+}
@@ -0,0 +1,1457 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/spf13/viper"
+)
+
+// mixedFixture は Python と Go の関数を 1 つずつ含むリポジトリ。
+var mixedFixture = map[string]string{
+	"a.py": "def py_func(x):\n    return x\n",
+	"b.go": "package b\n\nfunc GoFunc() int {\n\treturn 1\n}\n",
+}
+
+func TestReviewLanguagesFilter(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, mixedFixture)
+	report := reviewEcho(t, dir, map[string]any{"languages": []string{"py"}})
+	if !strings.Contains(report, "py_func") {
+		t.Errorf("Python function not reviewed:\n%s", report)
+	}
+	if strings.Contains(report, "GoFunc") {
+		t.Errorf("Go function reviewed despite languages=py:\n%s", report)
+	}
+}
+
+func TestReviewIgnoresLANGEnvironment(t *testing.T) {
+	// AutomaticEnv 下でもシェルの LANG が言語の絞り込みとして扱われないこと
+	t.Setenv("LANG", "en_US.UTF-8")
+	dir := t.TempDir()
+	writeTree(t, dir, mixedFixture)
+	echoConfig(t, nil)
+	viper.AutomaticEnv()
+	report := runReview(t, dir)
+	for _, name := range []string{"py_func", "GoFunc"} {
+		if !strings.Contains(report, name) {
+			t.Errorf("%s not reviewed with LANG set:\n%s", name, report)
+		}
+	}
+}
+
+func TestNeighborSignaturesSkipDecoratorsAndAnnotations(t *testing.T) {
+	resetConfig(t, nil)
+	tests := []struct {
+		ext, src string
+		want     []string
+	}{
+		{".py", "@app.route('/a')\n@login_required\ndef a():\n    pass\n\ndef b():\n    pass\n", []string{"def a():", "def b():"}},
+		{".java", "class C {\n  @Override\n  @Deprecated(since = \"1\")\n  public String toString() { return \"\"; }\n  @Test void t() {}\n}\n", []string{"public String toString() { return \"\"; }", "void t() {}"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ext, func(t *testing.T) {
+			funcs, err := ExtractFunctions([]byte(tt.src), tt.ext, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(funcs[0].Code), "@") {
+				t.Fatalf("decorators/annotations not kept in the chunk: %q", funcs[0].Code)
+			}
+			addNeighbors(funcs, 1)
+			if got := "after: " + tt.want[1] + "\n"; funcs[0].Neighbors != got {
+				t.Errorf("Neighbors[0] = %q, want %q", funcs[0].Neighbors, got)
+			}
+			if got := "before: " + tt.want[0] + "\n"; funcs[1].Neighbors != got {
+				t.Errorf("Neighbors[1] = %q, want %q", funcs[1].Neighbors, got)
+			}
+		})
+	}
+}
+
+func TestNormalizeMarkdown(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"trailing spaces and blank runs", "# A  \n\n\n\ntext\t\n\n\n", "# A\n\ntext\n"},
+		{"leading blank lines", "\n\n# A\n", "# A\n"},
+		{"empty", " \n\n", ""},
+		{
+			"fenced code untouched",
+			"## f\n\n```python\ndef f():  \n\n\n    return 1\t\n```\n\n\n\nafter  \n",
+			"## f\n\n```python\ndef f():  \n\n\n    return 1\t\n```\n\nafter\n",
+		},
+		{
+			"longer fence with inner fence",
+			"````text\nprompt  \n```go\n\n\nx\n```\n````\n\n\ntail\n",
+			"````text\nprompt  \n```go\n\n\nx\n```\n````\n\ntail\n",
+		},
+		{
+			"tilde fence and info string is not a close",
+			"~~~\na  \n~~~ not-a-close\n\n\nb \n~~~\n\n\nc\n",
+			"~~~\na  \n~~~ not-a-close\n\n\nb \n~~~\n\nc\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeMarkdown(tt.in); got != tt.want {
+				t.Errorf("normalizeMarkdown(%q) =\n%q\nwant\n%q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteReportSplitsIntoLinkedParts(t *testing.T) {
+	resetConfig(t, map[string]any{"max_report_bytes": 80})
+	dir := t.TempDir()
+	out := filepath.Join(dir, "report.md")
+	writeTree(t, dir, map[string]string{"report.part5.md": "stale", "report.partx.md": "unrelated"})
+	sections := []string{
+		"## a\n\n" + strings.Repeat("a", 40) + "\n\n",
+		"## b\n\n" + strings.Repeat("b", 40) + "\n\n",
+		"## c\n\n" + strings.Repeat("c", 40) + "\n\n",
+	}
+	if err := writeReport(out, []string{"Seed: 1"}, sections, false, 0644); err != nil {
+		t.Fatal(err)
+	}
+	read := func(name string) string {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	first, second, third := read("report.md"), read("report.part2.md"), read("report.part3.md")
+	if !strings.Contains(first, "## a") || !strings.Contains(first, "[Next](report.part2.md)") || strings.Contains(first, "Previous") {
+		t.Errorf("report.md:\n%s", first)
+	}
+	if !strings.Contains(second, "## b") || !strings.Contains(second, "[Previous](report.md) | [Next](report.part3.md)") {
+		t.Errorf("report.part2.md:\n%s", second)
+	}
+	if !strings.Contains(third, "## c") || !strings.Contains(third, "(part 3/3)") || strings.Contains(third, "Next") {
+		t.Errorf("report.part3.md:\n%s", third)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "report.part5.md")); !os.IsNotExist(err) {
+		t.Errorf("stale part file kept (err=%v)", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "report.partx.md")); err != nil {
+		t.Errorf("unrelated file removed: %v", err)
+	}
+}
+
+func TestReviewRejectsMaxReportBytesWithAppend(t *testing.T) {
+	resetConfig(t, map[string]any{"max_report_bytes": 80, "append": true})
+	dir := t.TempDir()
+	err := Review(context.Background(), dir, filepath.Join(dir, "report.md"))
+	if err == nil || !strings.Contains(err.Error(), "max_report_bytes") {
+		t.Fatalf("Review() error = %v, want max_report_bytes/append conflict", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "report.md")); !os.IsNotExist(err) {
+		t.Errorf("report written despite the conflict (err=%v)", err)
+	}
+}
+
+func TestIsReportFile(t *testing.T) {
+	out := filepath.Join("r", "report.md")
+	for path, want := range map[string]bool{
+		out:                                    true,
+		filepath.Join("r", "report.part2.md"):  true,
+		filepath.Join("r", "report.part12.md"): true,
+		filepath.Join("r", "report.part1.md"):  false,
+		filepath.Join("r", "report.partx.md"):  false,
+		filepath.Join("r", "report.part2.txt"): false,
+		filepath.Join("r", "other.md"):         false,
+	} {
+		if got := isReportFile(path, out); got != want {
+			t.Errorf("isReportFile(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestReviewSkipsReportParts(t *testing.T) {
+	root := t.TempDir()
+	fence := "```go\nfunc FromReport() {}\n```\n"
+	writeTree(t, root, map[string]string{
+		"doc.md":          "```go\nfunc FromDoc() {}\n```\n",
+		"report.md":       fence,
+		"report.part2.md": fence,
+	})
+	echoConfig(t, map[string]any{"review_markdown": true})
+	out := filepath.Join(root, "report.md")
+	if err := Review(context.Background(), root, out); err != nil {
+		t.Fatal(err)
+	}
+	report, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(report), "FromDoc") {
+		t.Errorf("Markdown fence in doc.md not reviewed:\n%s", report)
+	}
+	if strings.Count(string(report), "FromReport") > 0 {
+		t.Errorf("report part file was reviewed:\n%s", report)
+	}
+}
+
+func TestReviewWholeRepoAppliesFilters(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.go":    "package a\n\nfunc Kept() int {\n\treturn 1\n}\n\nfunc hidden() int {\n\treturn 2\n}\n\nfunc TestHelper() {}\n\n// ollama-review: ignore\nfunc Ignored() {}\n",
+		"big.py":  "def too_large():\n    return '" + strings.Repeat("x", 200) + "'\n",
+		"blob.go": "package a\x00\x01",
+	})
+	report := reviewEcho(t, dir, map[string]any{
+		"small_repo_threshold": 4096,
+		"exported_only":        true,
+		"exclude_func_regex":   []string{"^Test"},
+		"max_file_bytes":       150,
+	})
+	if !strings.Contains(report, "whole repository (1 files)") || !strings.Contains(report, "func Kept()") {
+		t.Fatalf("repository not reviewed as a single prompt:\n%s", report)
+	}
+	for _, name := range []string{"hidden", "TestHelper", "func Ignored", "too_large", "blob"} {
+		if strings.Contains(report, name) {
+			t.Errorf("%s included in the whole-repository prompt:\n%s", name, report)
+		}
+	}
+	if !strings.Contains(report, "| go | 1 | 1 |") {
+		t.Errorf("languages table not updated:\n%s", report)
+	}
+}
+
+func TestReviewWholeRepoFallbackReusesParsedFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.py": "def first():\n    return 1\n",
+		"b.py": "def second():\n    return 2\n",
+		"c.py": "def third():\n    return 3\n",
+	})
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	// 2 ファイル目で合計が上限を超え、関数単位のレビューに切り替わる
+	report := reviewEcho(t, dir, map[string]any{"small_repo_threshold": 40})
+	if strings.Contains(report, "whole repository") {
+		t.Fatalf("repository over the threshold reviewed as a single prompt:\n%s", report)
+	}
+	for _, name := range []string{"a.py", "b.py", "c.py"} {
+		if n := strings.Count(logs.String(), "Processing "+filepath.Join(dir, name)+"\n"); n != 1 {
+			t.Errorf("%s parsed %d times, want 1", name, n)
+		}
+	}
+	for _, name := range []string{"first", "second", "third"} {
+		if !strings.Contains(report, name) {
+			t.Errorf("%s not reviewed after the fallback:\n%s", name, report)
+		}
+	}
+}
+
+func TestReviewParseWorkersKeepOrder(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{}
+	for i := range 24 {
+		files[fmt.Sprintf("pkg%d/m%02d.py", i%3, i)] = fmt.Sprintf("def f%02d():\n    return %d\n", i, i)
+	}
+	writeTree(t, dir, files)
+	echoConfig(t, nil)
+	sequential := runReview(t, dir)
+	for i := range 24 {
+		if !strings.Contains(sequential, fmt.Sprintf("def f%02d", i)) {
+			t.Fatalf("f%02d not reviewed:\n%s", i, sequential)
+		}
+	}
+	viper.Set("parse_workers", 8)
+	if concurrent := runReview(t, dir); concurrent != sequential {
+		t.Errorf("report differs with parse_workers 8\n--- sequential\n%s\n--- concurrent\n%s", sequential, concurrent)
+	}
+}
+
+func TestReviewConcurrentChunksKeepOrder(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{}
+	for _, name := range []string{"a", "b"} {
+		var src strings.Builder
+		for i := range 6 {
+			fmt.Fprintf(&src, "def %s_%d():\n    return %d\n\n\n", name, i, i)
+		}
+		files[name+".py"] = src.String()
+	}
+	writeTree(t, dir, files)
+	ollama := newFakeOllama(t, 20*time.Millisecond)
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL})
+	sequential := runReview(t, dir)
+	if !strings.Contains(sequential, "def b_5") {
+		t.Fatalf("chunks not reviewed through the fake server:\n%s", sequential)
+	}
+	if peak := ollama.peakRequests(); peak != 1 {
+		t.Errorf("concurrency 1 sent %d requests at once", peak)
+	}
+	viper.Set("concurrency", 4)
+	concurrent := runReview(t, dir)
+	if peak := ollama.peakRequests(); peak < 2 || peak > 4 {
+		t.Errorf("concurrency 4 sent at most %d requests at once", peak)
+	}
+	if concurrent != sequential {
+		t.Errorf("report differs with concurrency 4\n--- sequential\n%s\n--- concurrent\n%s", sequential, concurrent)
+	}
+}
+
+func TestReviewOneSharesConcurrentReviewsOfTheSameChunk(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n"})
+	ollama := newFakeOllama(t, 100*time.Millisecond)
+	ollama.reply = func(req api.ChatRequest) api.ChatResponse {
+		return api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Content: "shared"}, Done: true,
+			Metrics: api.Metrics{PromptEvalCount: 10, EvalCount: 5}}
+	}
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL})
+	r, err := newReviewRun(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "a.py")
+	funcs := []Chunk{{Name: "f", Code: []byte("def f():\n    return 1"), StartLine: 1, EndLine: 2}}
+
+	const workers = 16
+	results := make([]reviewResult, workers)
+	errs := make([]error, workers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			results[i], _, errs[i] = r.reviewOne(t.Context(), path, ".py", funcs, 0, false)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if n := len(ollama.chatRequests()); n != 1 {
+		t.Errorf("%d concurrent reviews of one chunk sent %d requests, want 1", workers, n)
+	}
+	tokens := 0
+	for i, res := range results {
+		if errs[i] != nil || res.Raw != "shared" {
+			t.Errorf("worker %d: %q, %v", i, res.Raw, errs[i])
+		}
+		tokens += res.PromptTokens
+	}
+	if tokens != 10 {
+		t.Errorf("shared result counted %d prompt tokens, want 10", tokens)
+	}
+}
+
+func TestReviewIdenticalChunksConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	dup := "def dup():\n    return 1\n\n\n"
+	writeTree(t, dir, map[string]string{"a.py": dup + dup})
+	ollama := newFakeOllama(t, 50*time.Millisecond)
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "concurrency": 2})
+	report := runReview(t, dir)
+	if n := len(ollama.chatRequests()); n != 1 {
+		t.Errorf("identical chunks under concurrency sent %d requests, want 1", n)
+	}
+	if peak := ollama.peakRequests(); peak != 1 {
+		t.Errorf("identical chunks sent %d requests at once", peak)
+	}
+	if n := strings.Count(report, "a.py - dup (lines"); n != 2 {
+		t.Errorf("report has %d sections for the duplicated chunk, want 2:\n%s", n, report)
+	}
+}
+
+func TestShippedGuidelineRendersContext(t *testing.T) {
+	tmpl, err := template.ParseFiles(filepath.Join("..", "guidelines.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetConfig(t, map[string]any{"review_language": "English"})
+	fn := Chunk{Name: "f", Code: []byte("def f(): g()"), Doc: "Docs for f.", Blame: "last changed by Alice", Neighbors: "def h():", Callees: []string{"g"}}
+	prompt, err := buildPrompt(tmpl, "py", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Docs for f.", "last changed by Alice", "def h():", "この関数が呼び出す関数：g", "Respond in English."} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("prompt missing %q:\n%s", want, prompt)
+		}
+	}
+	resetConfig(t, nil)
+	prompt, err = buildPrompt(tmpl, "py", Chunk{Name: "f", Code: fn.Code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, absent := range []string{"関数のドキュメント", "直近の変更", "前後の関数", "呼び出す関数"} {
+		if strings.Contains(prompt, absent) {
+			t.Errorf("empty context rendered %q:\n%s", absent, prompt)
+		}
+	}
+	if !strings.Contains(prompt, "Respond in Japanese.") {
+		t.Errorf("default response language missing:\n%s", prompt)
+	}
+}
+
+func TestReviewAppendKeepsPreviousSections(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def first_run():\n    return 1\n"})
+	echoConfig(t, map[string]any{"append": true})
+	out := filepath.Join(t.TempDir(), "report.md")
+	runReviewTo(t, dir, out)
+	writeTree(t, dir, map[string]string{"a.py": "def second_run():\n    return 2\n"})
+	report := runReviewTo(t, dir, out)
+	if n := strings.Count(report, "# Code Review Report"); n != 2 {
+		t.Errorf("report has %d sections, want 2:\n%s", n, report)
+	}
+	first, second := strings.Index(report, "first_run"), strings.Index(report, "second_run")
+	if first < 0 || second < first {
+		t.Errorf("appended section missing or out of order:\n%s", report)
+	}
+}
+
+func TestReviewMinComplexity(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.py": "def trivial():\n    return 1\n\n\ndef branchy(x):\n    if x:\n        return 1\n    for i in x:\n        while i:\n            i -= 1\n    return 0\n",
+	})
+	report := reviewEcho(t, dir, map[string]any{"min_complexity": 3})
+	if !strings.Contains(report, "def branchy") {
+		t.Errorf("branchy function not reviewed:\n%s", report)
+	}
+	if strings.Contains(report, "def trivial") {
+		t.Errorf("function below min_complexity reviewed:\n%s", report)
+	}
+}
+
+func TestReviewPassesDocstringAsDoc(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.py": "def add(a, b):\n    \"\"\"Return the sum of a and b.\"\"\"\n    return a + b\n",
+	})
+	templateConfig(t, "doc=[{{.doc}}]", map[string]any{"include_docstrings": true})
+	if report := runReview(t, dir); !strings.Contains(report, "doc=[") || !strings.Contains(report, "Return the sum of a and b.") {
+		t.Errorf("docstring not passed as doc:\n%s", report)
+	}
+	viper.Set("include_docstrings", false)
+	if report := runReview(t, dir); strings.Contains(report, "Return the sum") {
+		t.Errorf("doc populated with include_docstrings disabled:\n%s", report)
+	}
+}
+
+func TestReviewAnonymizePaths(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"pkg/a.py": "def f():\n    return 1\n"})
+	report := reviewEcho(t, dir, map[string]any{"anonymize_paths": true})
+	if strings.Contains(report, dir) {
+		t.Errorf("absolute repository path leaked into the report:\n%s", report)
+	}
+	if !strings.Contains(report, anonymizedRoot+"/pkg/a.py") {
+		t.Errorf("anonymized path missing:\n%s", report)
+	}
+	viper.Set("anonymize_paths", false)
+	if report := runReview(t, dir); !strings.Contains(report, dir) {
+		t.Errorf("repository path missing with anonymize_paths disabled:\n%s", report)
+	}
+}
+
+func TestReviewMaxOutputTokens(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n"})
+	ollama := newFakeOllama(t, 0)
+	ollama.reply = func(req api.ChatRequest) api.ChatResponse {
+		return api.ChatResponse{
+			Model:      req.Model,
+			Message:    api.Message{Role: "assistant", Content: "partial review"},
+			Done:       true,
+			DoneReason: "length",
+		}
+	}
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "max_output_tokens": 64})
+	report := runReview(t, dir)
+	reqs := ollama.chatRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d chat requests, want 1", len(reqs))
+	}
+	if got := reqs[0].Options["num_predict"]; got != float64(64) {
+		t.Errorf("num_predict = %v, want 64", got)
+	}
+	if !strings.Contains(report, "response truncated at max_output_tokens (64)") {
+		t.Errorf("truncation note missing:\n%s", report)
+	}
+}
+
+func TestReviewExcludeRelativeToSubdirectoryRoot(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"build/top.py":            "def top_level():\n    return 1\n",
+		"build/lib/gen/a.py":      "def generated():\n    return 1\n",
+		"build/gen/b.py":          "def other_gen():\n    return 1\n",
+		"build/nested/build/c.py": "def nested_build():\n    return 1\n",
+	})
+	// 起点のディレクトリ名と同じ除外名は起点自体には適用しない
+	report := reviewEcho(t, filepath.Join(dir, "build"), map[string]any{"exclude": []string{"build", "lib/gen"}})
+	for _, name := range []string{"top_level", "other_gen"} {
+		if !strings.Contains(report, name) {
+			t.Errorf("%s not reviewed:\n%s", name, report)
+		}
+	}
+	for _, name := range []string{"generated", "nested_build"} {
+		if strings.Contains(report, name) {
+			t.Errorf("%s reviewed despite exclude:\n%s", name, report)
+		}
+	}
+}
+
+func TestReviewCreatesNestedOutputDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n"})
+	echoConfig(t, map[string]any{"output_mode_bits": "0600"})
+	out := filepath.Join(t.TempDir(), "reports", "2024", "report.md")
+	if report := runReviewTo(t, dir, out); !strings.Contains(report, "def f") {
+		t.Fatalf("report not written:\n%s", report)
+	}
+	info, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Mode().Perm(); got != 0600 {
+		t.Errorf("report mode = %o, want 600", got)
+	}
+}
+
+func TestReviewSourceLineRange(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.py": "def first():\n    return 1\n\n\ndef second():\n    return 2\n\n\ndef third():\n    return 3\n",
+	})
+	src := filepath.Join(dir, "a.py")
+	ollama := newFakeOllama(t, 0)
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL})
+	runReview(t, src+":5:6")
+	reqs := ollama.chatRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d chat requests, want 1", len(reqs))
+	}
+	prompt := reqs[0].Messages[len(reqs[0].Messages)-1].Content
+	if !strings.Contains(prompt, "def second") || strings.Contains(prompt, "def first") || strings.Contains(prompt, "def third") {
+		t.Errorf("prompt not limited to lines 5-6:\n%s", prompt)
+	}
+	for _, spec := range []string{":6:5", ":5:99"} {
+		if err := Review(context.Background(), src+spec, filepath.Join(t.TempDir(), "report.md")); err == nil {
+			t.Errorf("Review(%q) accepted an invalid range", spec)
+		}
+	}
+}
+
+func TestReviewSeedInRequestAndMetadata(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n"})
+	ollama := newFakeOllama(t, 0)
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "deterministic": false, "seed": 4242})
+	report := runReview(t, dir)
+	reqs := ollama.chatRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d chat requests, want 1", len(reqs))
+	}
+	if got := reqs[0].Options["seed"]; got != float64(4242) {
+		t.Errorf("request seed = %v, want 4242", got)
+	}
+	if !strings.Contains(report, "Seed: 4242") {
+		t.Errorf("seed missing from the report metadata:\n%s", report)
+	}
+
+	// 未指定なら乱数で決めた seed を要求とメタデータの両方に載せる
+	resetConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "guideline": viper.GetString("guideline")})
+	report = runReview(t, dir)
+	reqs = ollama.chatRequests()
+	seed, ok := reqs[len(reqs)-1].Options["seed"].(float64)
+	if !ok {
+		t.Fatalf("random seed not forwarded: %v", reqs[len(reqs)-1].Options)
+	}
+	if want := fmt.Sprintf("Seed: %d", int(seed)); !strings.Contains(report, want) {
+		t.Errorf("report metadata missing %q:\n%s", want, report)
+	}
+	// 乱数で決めた seed は設定へ書き戻さず、以降の実行（watch など）へ持ち越さない
+	if viper.IsSet("seed") {
+		t.Errorf("random seed %v written back to the config", viper.Get("seed"))
+	}
+}
+
+func TestReviewSkipsBlankAndCommentOnlyFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"empty.py":    "",
+		"blank.go":    "\n  \n\t\n",
+		"comments.go": "// Package note.\n/* block\n   comment */\n",
+		"comments.py": "# only a comment\n",
+		"a.py":        "def f():\n    return 1\n",
+	})
+	report := reviewEcho(t, dir, nil)
+	if !strings.Contains(report, "| empty | 4 |") {
+		t.Errorf("blank and comment-only files not skipped as empty:\n%s", report)
+	}
+	if strings.Contains(report, "| no functions |") || strings.Contains(report, "| parse error |") {
+		t.Errorf("blank files reached the parser:\n%s", report)
+	}
+	if !strings.Contains(report, "def f") {
+		t.Errorf("source file not reviewed:\n%s", report)
+	}
+}
+
+func TestReviewModuleLevelScript(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"script.py": "import sys\n\nprint(sys.argv[1])\n"})
+	report := reviewEcho(t, dir, map[string]any{"review_module_level": true})
+	if !strings.Contains(report, "print(sys.argv[1])") {
+		t.Errorf("module-level chunk not reviewed:\n%s", report)
+	}
+	viper.Set("review_module_level", false)
+	if report := runReview(t, dir); strings.Contains(report, "print(sys.argv[1])") {
+		t.Errorf("script reviewed with review_module_level disabled:\n%s", report)
+	}
+}
+
+func TestReviewGuidelinePartials(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n"})
+	parts := t.TempDir()
+	writeTree(t, parts, map[string]string{
+		"rubric.tmpl": `{{define "rubric"}}Severity: high / medium / low{{end}}`,
+		"tone.tmpl":   `{{define "tone"}}Be concise.{{end}}`,
+	})
+	templateConfig(t, `{{template "rubric"}} {{template "tone"}} {{.code}}`, map[string]any{
+		"guideline_partials": []string{filepath.Join(parts, "*.tmpl")},
+	})
+	report := runReview(t, dir)
+	for _, want := range []string{"Severity: high / medium / low", "Be concise.", "def f"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("rendered prompt missing %q:\n%s", want, report)
+		}
+	}
+}
+
+func TestReviewNotesPartiallyParsedFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.py": "def valid():\n    return 1\n\n\ndef broken(:\n    return (\n",
+		"b.py": "def clean():\n    return 2\n",
+	})
+	report := reviewEcho(t, dir, nil)
+	if !strings.Contains(report, "def valid") {
+		t.Errorf("valid function in the broken file not reviewed:\n%s", report)
+	}
+	if n := strings.Count(report, "this file contains syntax errors"); n != 1 {
+		t.Errorf("got %d partial-parse notes, want 1:\n%s", n, report)
+	}
+	if !strings.Contains(report, "Partially parsed files: 1") {
+		t.Errorf("partial file not counted in the metadata:\n%s", report)
+	}
+}
+
+func TestReviewFewShotPrecedesChunk(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n"})
+	ollama := newFakeOllama(t, 0)
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "few_shot": []map[string]any{
+		{"user": "def g(): pass", "assistant": "No issues."},
+	}})
+	runReview(t, dir)
+	reqs := ollama.chatRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d chat requests, want 1", len(reqs))
+	}
+	var got []string
+	for _, m := range reqs[0].Messages {
+		if m.Role != "system" {
+			got = append(got, m.Role+": "+m.Content)
+		}
+	}
+	if len(got) != 3 || got[0] != "user: def g(): pass" || got[1] != "assistant: No issues." || !strings.HasPrefix(got[2], "user: def f") {
+		t.Errorf("messages = %q, want the example pair before the chunk", got)
+	}
+}
+
+func TestReviewHonorsReviewIgnore(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		".reviewignore":    "# generated code\ngenerated/\n*_pb.py\n",
+		"generated/a.py":   "def generated_func():\n    return 1\n",
+		"api_pb.py":        "def proto_func():\n    return 1\n",
+		"src/generated.py": "def kept_file():\n    return 1\n",
+		"src/main.py":      "def main_func():\n    return 1\n",
+	})
+	report := reviewEcho(t, dir, nil)
+	for _, name := range []string{"kept_file", "main_func"} {
+		if !strings.Contains(report, name) {
+			t.Errorf("%s not reviewed:\n%s", name, report)
+		}
+	}
+	for _, name := range []string{"generated_func", "proto_func"} {
+		if strings.Contains(report, name) {
+			t.Errorf("%s reviewed despite .reviewignore:\n%s", name, report)
+		}
+	}
+}
+
+func TestReviewRunTimeoutWritesPartialReport(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.py": "def first():\n    return 1\n",
+		"b.py": "def second():\n    return 2\n",
+		"c.py": "def third():\n    return 3\n",
+	})
+	ollama := newFakeOllama(t, 200*time.Millisecond)
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL})
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	out := filepath.Join(t.TempDir(), "report.md")
+	if err := Review(ctx, dir, out); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Review = %v, want context.DeadlineExceeded", err)
+	}
+	report, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("partial report not written: %v", err)
+	}
+	if !strings.Contains(string(report), "def first") {
+		t.Errorf("completed chunk missing from the partial report:\n%s", report)
+	}
+	if strings.Contains(string(report), "def third") {
+		t.Errorf("chunk after the deadline reviewed:\n%s", report)
+	}
+}
+
+func TestReviewDeterministicReportIsStable(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, mixedFixture)
+	ollama := newFakeOllama(t, 0)
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL})
+	first := runReview(t, dir)
+	second := runReview(t, dir)
+	if first != second {
+		t.Errorf("deterministic reports differ\n--- first\n%s\n--- second\n%s", first, second)
+	}
+	if !strings.Contains(first, "Seed: 0") {
+		t.Errorf("deterministic report does not use the fixed seed:\n%s", first)
+	}
+	for _, req := range ollama.chatRequests() {
+		if req.Options["temperature"] != float64(0) || req.Options["seed"] != float64(0) {
+			t.Errorf("request options = %v, want temperature 0 and seed 0", req.Options)
+		}
+	}
+}
+
+func TestReviewWritesReportToStdout(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n"})
+	echoConfig(t, nil)
+	t.Chdir(t.TempDir())
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = Review(context.Background(), dir, stdoutPath)
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(got), "# Code Review Report") || !strings.Contains(string(got), "def f") {
+		t.Errorf("report not written to stdout:\n%s", got)
+	}
+	if entries, _ := os.ReadDir("."); len(entries) != 0 {
+		t.Errorf("files created with output -: %v", entries)
+	}
+}
+
+func TestReviewDisambiguatesSameNamedFunctions(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"C.java": "class C {\n  int parse(String s) {\n    return 1;\n  }\n\n  int parse(byte[] b) {\n    return 2;\n  }\n}\n",
+	})
+	report := reviewEcho(t, dir, nil)
+	var headings []string
+	for _, line := range strings.Split(report, "\n") {
+		if strings.HasPrefix(line, "#") && strings.Contains(line, "parse") {
+			headings = append(headings, line)
+		}
+	}
+	if len(headings) != 2 || headings[0] == headings[1] {
+		t.Fatalf("headings for overloaded parse not unique: %q", headings)
+	}
+	if !strings.Contains(headings[0], "lines 2-4") || !strings.Contains(headings[1], "lines 6-8") {
+		t.Errorf("headings lack ordered line ranges: %q", headings)
+	}
+}
+
+func TestReviewDefaultExcludesVendor(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"vendor/lib/a.py": "def vendored():\n    return 1\n",
+		"main.py":         "def own():\n    return 1\n",
+	})
+	report := reviewEcho(t, dir, nil)
+	if strings.Contains(report, "vendored") || !strings.Contains(report, "own") {
+		t.Errorf("vendor/ not skipped by default:\n%s", report)
+	}
+	viper.Set("use_default_excludes", false)
+	if report := runReview(t, dir); !strings.Contains(report, "vendored") {
+		t.Errorf("vendor/ skipped with use_default_excludes disabled:\n%s", report)
+	}
+}
+
+func TestReviewNeighborContextForMiddleFunction(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.py": "def first(a):\n    return 'first body'\n\n\ndef second(b):\n    return 'second body'\n\n\ndef third(c):\n    return 'third body'\n",
+	})
+	ollama := newFakeOllama(t, 0)
+	templateConfig(t, "{{.neighbors}}---\n{{.code}}", map[string]any{"model": "fake", "OllamaHost": ollama.URL, "neighbor_context": 1})
+	runReview(t, dir)
+	var prompt string
+	for _, req := range ollama.chatRequests() {
+		if c := req.Messages[len(req.Messages)-1].Content; strings.Contains(c, "---\ndef second") {
+			prompt = c
+		}
+	}
+	if prompt == "" {
+		t.Fatal("middle function not reviewed")
+	}
+	for _, want := range []string{"before: def first(a):", "after: def third(c):"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("prompt missing neighbor signature %q:\n%s", want, prompt)
+		}
+	}
+	if strings.Contains(prompt, "first body") || strings.Contains(prompt, "third body") {
+		t.Errorf("neighbor bodies included in the prompt:\n%s", prompt)
+	}
+}
+
+func TestReviewLanguageInOutgoingPrompt(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n"})
+	ollama := newFakeOllama(t, 0)
+	templateConfig(t, "lang={{.review_language}}\n{{.code}}", map[string]any{"model": "fake", "OllamaHost": ollama.URL, "review_language": "Japanese"})
+	runReview(t, dir)
+	reqs := ollama.chatRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d chat requests, want 1", len(reqs))
+	}
+	msgs := reqs[0].Messages
+	if msgs[0].Role != "system" || msgs[0].Content != "Respond in Japanese." {
+		t.Errorf("first message = %+v, want the response language instruction", msgs[0])
+	}
+	if !strings.HasPrefix(msgs[len(msgs)-1].Content, "lang=Japanese\n") {
+		t.Errorf("review_language not passed to the template:\n%s", msgs[len(msgs)-1].Content)
+	}
+
+	viper.Set("review_language", "")
+	runReview(t, dir)
+	reqs = ollama.chatRequests()
+	for _, m := range reqs[len(reqs)-1].Messages {
+		if strings.HasPrefix(m.Content, "Respond in") {
+			t.Errorf("language instruction sent without review_language: %+v", m)
+		}
+	}
+}
+
+func TestReviewSavesRawResponses(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"pkg/a.py": "def f():\n    return 1\n\n\ndef g():\n    return 2\n"})
+	ollama := newFakeOllama(t, 0)
+	ollama.reply = func(req api.ChatRequest) api.ChatResponse {
+		code := req.Messages[len(req.Messages)-1].Content
+		return api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Content: "raw for " + code[:len("def f")]}, Done: true}
+	}
+	raw := filepath.Join(t.TempDir(), "raw")
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "save_raw": raw})
+	runReview(t, dir)
+	for name, want := range map[string]string{
+		"pkg_a.py.001.f.txt": "raw for def f",
+		"pkg_a.py.002.g.txt": "raw for def g",
+	} {
+		got, err := os.ReadFile(filepath.Join(raw, name))
+		if err != nil {
+			t.Errorf("raw response not saved: %v", err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReviewTodoComments(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.go": "package a\n\n// TODO: handle negative input\nfunc Abs(x int) int {\n\treturn x\n}\n\n// plain comment\n",
+	})
+	todoGuideline := filepath.Join(t.TempDir(), "todo.tmpl")
+	if err := os.WriteFile(todoGuideline, []byte("assess: {{.code}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report := reviewEcho(t, dir, map[string]any{"review_todos": true, "todo_guideline": todoGuideline})
+	i := strings.Index(report, "# TODO / FIXME Review")
+	if i < 0 {
+		t.Fatalf("TODO section missing:\n%s", report)
+	}
+	todo := report[i:]
+	if !strings.Contains(todo, "assess: // TODO: handle negative input") {
+		t.Errorf("TODO comment not reviewed with todo_guideline:\n%s", todo)
+	}
+	if strings.Contains(todo, "plain comment") {
+		t.Errorf("comment without a marker extracted:\n%s", todo)
+	}
+}
+
+func TestReviewExcludeFuncRegex(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.go": "package a\n\nfunc mockStore() {}\n\nfunc _generated() {}\n\nfunc Handle() {}\n\nfunc parse() {}\n",
+	})
+	report := reviewEcho(t, dir, map[string]any{"exclude_func_regex": []string{"^mock", "^_"}})
+	for _, name := range []string{"func Handle", "func parse"} {
+		if !strings.Contains(report, name) {
+			t.Errorf("%s not reviewed:\n%s", name, report)
+		}
+	}
+	for _, name := range []string{"mockStore", "_generated"} {
+		if strings.Contains(report, name) {
+			t.Errorf("%s reviewed despite exclude_func_regex:\n%s", name, report)
+		}
+	}
+}
+
+func TestReviewWritesStepSummary(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.py":     "def f():\n    return 1\n\n\ndef g():\n    return 2\n",
+		"b.py":     "def valid():\n    return 1\n\n\ndef broken(:\n",
+		"empty.py": "",
+	})
+	summary := filepath.Join(t.TempDir(), "summary.md")
+	t.Setenv("GITHUB_STEP_SUMMARY", summary)
+	report := reviewEcho(t, dir, nil)
+	got, err := os.ReadFile(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 構文エラーのあるファイルからも回復できた関数はレビューされる
+	reviewed := strings.Count(report, `<a id="chunk-`)
+	if reviewed < 3 {
+		t.Fatalf("only %d chunks reviewed:\n%s", reviewed, report)
+	}
+	if want := fmt.Sprintf("`reviewed=%d failed_chunks=0 oversized_chunks=0 partial_files=1 skipped_files=1`\n", reviewed); string(got) != want {
+		t.Errorf("step summary = %q, want %q", got, want)
+	}
+}
+
+func TestReviewGenerateMode(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    x = 1\n    return x\n"})
+	ollama := newFakeOllama(t, 0)
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "mode": "generate"})
+	report := runReview(t, dir)
+	if n := len(ollama.chatRequests()); n != 0 {
+		t.Errorf("generate mode sent %d chat requests", n)
+	}
+	prompts := ollama.generatePrompts()
+	if len(prompts) != 1 || prompts[0] != "def f():\n    x = 1\n    return x" {
+		t.Fatalf("generate prompts = %q", prompts)
+	}
+	// 行ごとに分かれて届いた応答がつなぎ合わされていること
+	if !strings.Contains(report, "def f():\n    x = 1\n    return x") {
+		t.Errorf("streamed response not accumulated:\n%s", report)
+	}
+}
+
+func TestReviewStopsRetryingWhenBudgetIsSpent(t *testing.T) {
+	delay := retryDelay
+	retryDelay = time.Millisecond
+	t.Cleanup(func() { retryDelay = delay })
+	dir := t.TempDir()
+	var src strings.Builder
+	for i := range 5 {
+		fmt.Fprintf(&src, "def f%d():\n    return %d\n\n\n", i, i)
+	}
+	writeTree(t, dir, map[string]string{"a.py": src.String()})
+	ollama := newFakeOllama(t, 0)
+	ollama.chatError = "model overloaded"
+	summary := filepath.Join(t.TempDir(), "summary.md")
+	t.Setenv("GITHUB_STEP_SUMMARY", summary)
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "max_retries": 3, "total_retry_budget": 2})
+	runReview(t, dir)
+	// 各チャンク 1 回ずつに加え、予算の 2 回だけ再試行する
+	if n := len(ollama.chatRequests()); n != 5+2 {
+		t.Errorf("sent %d chat requests, want 7", n)
+	}
+	got, err := os.ReadFile(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "failed_chunks=5") {
+		t.Errorf("failures not recorded after the budget was spent: %s", got)
+	}
+}
+
+func TestReviewStripComments(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.py": "def f(x):\n    \"\"\"Doc kept.\"\"\"\n    # inline note\n    return x  # trailing note\n",
+	})
+	ollama := newFakeOllama(t, 0)
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "strip_comments": true})
+	report := runReview(t, dir)
+	reqs := ollama.chatRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d chat requests, want 1", len(reqs))
+	}
+	prompt := reqs[0].Messages[len(reqs[0].Messages)-1].Content
+	if strings.Contains(prompt, "inline note") || strings.Contains(prompt, "trailing note") {
+		t.Errorf("comments not stripped:\n%s", prompt)
+	}
+	for _, want := range []string{"def f(x):", "Doc kept.", "return x"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("prompt missing %q:\n%s", want, prompt)
+		}
+	}
+	if !strings.Contains(report, "Comments stripped before review: 1 chunks") {
+		t.Errorf("stripping not recorded in the metadata:\n%s", report)
+	}
+
+	viper.Set("keep_docstrings", false)
+	runReview(t, dir)
+	reqs = ollama.chatRequests()
+	if prompt := reqs[len(reqs)-1].Messages[len(reqs[len(reqs)-1].Messages)-1].Content; strings.Contains(prompt, "Doc kept.") {
+		t.Errorf("docstring kept with keep_docstrings disabled:\n%s", prompt)
+	}
+}
+
+func TestReviewCountsSkippedFiles(t *testing.T) {
+	// 抽出器の失敗は構文解析の失敗として数える
+	RegisterExtractor(".rb", func([]byte) ([]Chunk, error) { return nil, errors.New("unsupported syntax") })
+	t.Cleanup(func() { RegisterExtractor(".rb", nil) })
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"ok.py":      "def f():\n    return 1\n",
+		"bad.rb":     "def f; end\n",
+		"blob.go":    "package a\x00\x01",
+		"big.py":     "def big():\n    return '" + strings.Repeat("x", 300) + "'\n",
+		"empty.py":   "",
+		"empty2.go":  "// only a comment\n",
+		"nofunc.py":  "X = 1\n",
+		"nofunc2.go": "package a\n\nvar X = 1\n",
+	})
+	if err := os.Symlink(filepath.Join(dir, "missing.py"), filepath.Join(dir, "dangling.py")); err != nil {
+		t.Skip(err)
+	}
+	report := reviewEcho(t, dir, map[string]any{"max_file_bytes": 200})
+	for _, want := range []string{"| read error | 1 |", "| parse error | 1 |", "| binary | 1 |", "| size limit | 1 |", "| empty | 2 |", "| no functions | 2 |"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Skipped Files missing %q:\n%s", want, report)
+		}
+	}
+}
+
+func TestReviewGoTypes(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.go": "package a\n\n// Store persists items.\ntype Store interface {\n\tPut(key string) error\n}\n\ntype memStore struct {\n\titems map[string]bool\n}\n\nfunc New() Store {\n\treturn nil\n}\n",
+	})
+	report := reviewEcho(t, dir, map[string]any{"review_go_types": true})
+	for _, want := range []string{"## " + filepath.Join(dir, "a.go") + " - Store (lines 4-6", "memStore (lines 8-10", "New (lines 12-14"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report missing %q:\n%s", want, report)
+		}
+	}
+	viper.Set("review_go_types", false)
+	if report := runReview(t, dir); strings.Contains(report, "memStore") {
+		t.Errorf("type declarations reviewed with review_go_types disabled:\n%s", report)
+	}
+}
+
+func TestReviewCountsChunksPerLanguage(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.py":   "def a():\n    return 1\n\n\ndef b():\n    return 2\n",
+		"c.py":   "def c():\n    return 3\n",
+		"d.go":   "package d\n\nfunc D() {}\n",
+		"E.java": "class E {\n  void e() {}\n  void f() {}\n  void g() {}\n}\n",
+	})
+	report := reviewEcho(t, dir, nil)
+	for _, want := range []string{"| go | 1 | 1 |", "| java | 1 | 3 |", "| py | 2 | 3 |"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Languages table missing %q:\n%s", want, report)
+		}
+	}
+}
+
+func TestReviewGuidelinePathErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n"})
+	for _, tt := range []struct {
+		guideline string
+		want      string
+	}{
+		{dir, "is a directory, expected a template file"},
+		{filepath.Join(dir, "missing.tmpl"), "file does not exist"},
+	} {
+		resetConfig(t, map[string]any{"model": echoModel, "guideline": tt.guideline})
+		err := Review(context.Background(), dir, filepath.Join(t.TempDir(), "report.md"))
+		if err == nil || !strings.Contains(err.Error(), "guideline") || !strings.Contains(err.Error(), tt.guideline) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Review with guideline %s = %v, want an error naming the key and path (%s)", tt.guideline, err, tt.want)
+		}
+	}
+}
+
+func TestReviewCRLFLineNumbers(t *testing.T) {
+	dir := t.TempDir()
+	src := "# header\r\n\r\ndef first():\r\n    return 1\r\n\r\n\r\ndef second():\r\n    x = 1\r\n    return x\r\n"
+	writeTree(t, dir, map[string]string{"a.py": src})
+	report := reviewEcho(t, dir, nil)
+	for _, want := range []string{"first (lines 3-4,", "second (lines 7-9,"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report missing %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "\r") {
+		t.Errorf("carriage returns left in the report:\n%q", report)
+	}
+}
+
+func TestReviewMarkdownFencedBlocks(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"docs/guide.md": "# Guide\n\n```go\nfunc Example() int {\n\treturn 42\n}\n```\n\n```\nplain text block\n```\n\n```sh\necho skipped\n```\n",
+	})
+	templateConfig(t, "lang={{.lang}}\n{{.code}}", map[string]any{"review_markdown": true})
+	report := runReview(t, dir)
+	if !strings.Contains(report, "lang=go\nfunc Example() int {") {
+		t.Errorf("fenced Go block not reviewed as go:\n%s", report)
+	}
+	for _, absent := range []string{"plain text block", "echo skipped"} {
+		if strings.Contains(report, absent) {
+			t.Errorf("block without a supported language reviewed (%q):\n%s", absent, report)
+		}
+	}
+}
+
+func TestReviewMarkdownBlocksUseTheirLanguage(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"guide.md": "```go\nfunc Example() {}\n```\n\n```python\ndef example():\n    pass\n```\n",
+		"a.py":     "def script():\n    pass\n",
+	})
+	report := reviewEcho(t, dir, map[string]any{"review_markdown": true})
+	for _, row := range []string{"| go | 1 | 1 |", "| py | 2 | 2 |"} {
+		if !strings.Contains(report, row) {
+			t.Errorf("language table missing %q:\n%s", row, report)
+		}
+	}
+	if strings.Contains(report, "| md |") {
+		t.Errorf("code blocks counted as md:\n%s", report)
+	}
+
+	report = reviewEcho(t, dir, map[string]any{"review_markdown": true, "languages": []string{"go"}})
+	if !strings.Contains(report, "func Example") {
+		t.Errorf("Go block dropped under --lang go:\n%s", report)
+	}
+	if strings.Contains(report, "def example") || strings.Contains(report, "def script") {
+		t.Errorf("Python reviewed under --lang go:\n%s", report)
+	}
+}
+
+func TestReviewStrictParse(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"bad.py":  "def ok():\n    return 1\n\n\ndef broken(:\n",
+		"good.py": "def fine():\n    return 2\n",
+	})
+	report := reviewEcho(t, dir, nil)
+	if !strings.Contains(report, "def fine") {
+		t.Errorf("run did not continue past the unparseable file:\n%s", report)
+	}
+	viper.Set("strict_parse", true)
+	err := Review(context.Background(), dir, filepath.Join(t.TempDir(), "report.md"))
+	if err == nil || !strings.Contains(err.Error(), "strict_parse") || !strings.Contains(err.Error(), "bad.py") {
+		t.Errorf("Review = %v, want a strict_parse failure naming bad.py", err)
+	}
+}
+
+func TestReviewCalleesInPrompt(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.go": "package a\n\nfunc Handle(r *Request) error {\n\tdata, err := decode(r.Body)\n\tif err != nil {\n\t\treturn wrap(err)\n\t}\n\treturn store.Save(data)\n}\n",
+	})
+	templateConfig(t, "callees=[{{.callees}}]", map[string]any{"include_callees": true})
+	report := runReview(t, dir)
+	if !strings.Contains(report, "callees=[decode, wrap, store.Save]") {
+		t.Errorf("callees missing from the prompt:\n%s", report)
+	}
+	viper.Set("include_callees", false)
+	if report := runReview(t, dir); !strings.Contains(report, "callees=[]") {
+		t.Errorf("callees passed with include_callees disabled:\n%s", report)
+	}
+}
+
+func TestReviewSkipsOutputFileInsideRepo(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n"})
+	// 出力先がレビュー対象の拡張子でも、前回のレポートをレビューしないこと
+	out := filepath.Join(dir, "review_out.py")
+	echoConfig(t, nil)
+	runReviewTo(t, dir, out)
+	report := runReviewTo(t, dir, out)
+	if n := strings.Count(report, "def f():"); n != 1 {
+		t.Errorf("report reviewed itself (%d copies of def f):\n%s", n, report)
+	}
+	if strings.Contains(report, "review_out.py") {
+		t.Errorf("output file listed in the report:\n%s", report)
+	}
+}
+
+func TestReviewExportedOnly(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.go":   "package a\n\nfunc Public() {}\n\nfunc private() {}\n",
+		"b.py":   "def visible():\n    pass\n\n\ndef _hidden():\n    pass\n",
+		"C.java": "class C {\n  public void api() {}\n  void internal() {}\n}\n",
+	})
+	report := reviewEcho(t, dir, map[string]any{"exported_only": true})
+	for _, name := range []string{"func Public", "def visible", "void api"} {
+		if !strings.Contains(report, name) {
+			t.Errorf("exported %s not reviewed:\n%s", name, report)
+		}
+	}
+	for _, name := range []string{"func private", "_hidden", "internal"} {
+		if strings.Contains(report, name) {
+			t.Errorf("unexported %s reviewed:\n%s", name, report)
+		}
+	}
+}
+
+func TestReviewInlineSuppression(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.go": "package a\n\n// ollama-review: ignore\nfunc Legacy() int {\n\treturn 1\n}\n\nfunc Current() int { // ollama-review: ignore\n\treturn 2\n}\n\nfunc Reviewed() int {\n\treturn 3\n}\n",
+	})
+	report := reviewEcho(t, dir, nil)
+	if !strings.Contains(report, "func Reviewed") {
+		t.Errorf("unsuppressed function not reviewed:\n%s", report)
+	}
+	for _, name := range []string{"return 1", "return 2"} {
+		if strings.Contains(report, name) {
+			t.Errorf("suppressed function reviewed (%s):\n%s", name, report)
+		}
+	}
+	i := strings.Index(report, "# Suppressed")
+	if i < 0 {
+		t.Fatalf("Suppressed section missing:\n%s", report)
+	}
+	for _, name := range []string{"Legacy (lines 4-6", "Current (lines 8-10"} {
+		if !strings.Contains(report[i:], name) {
+			t.Errorf("suppression of %s not recorded:\n%s", name, report[i:])
+		}
+	}
+}
+
+func TestReviewGuidelineHashTracksContent(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n"})
+	hashOf := func(report string) string {
+		for _, line := range strings.Split(report, "\n") {
+			if h, ok := strings.CutPrefix(line, "- Guideline: "); ok {
+				return h
+			}
+		}
+		t.Fatalf("guideline hash missing from the metadata:\n%s", report)
+		return ""
+	}
+	templateConfig(t, "v1 {{.code}}", nil)
+	first := hashOf(runReview(t, dir))
+	if again := hashOf(runReview(t, dir)); again != first {
+		t.Errorf("hash changed without a template change: %s -> %s", first, again)
+	}
+	if err := os.WriteFile(viper.GetString("guideline"), []byte("v2 {{.code}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if second := hashOf(runReview(t, dir)); second == first {
+		t.Errorf("hash %s unchanged after editing the guideline", first)
+	}
+}
+
+func TestReviewForwardsStopSequences(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n"})
+	ollama := newFakeOllama(t, 0)
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "stop": []string{"</review>", "\n\n\n"}})
+	runReview(t, dir)
+	reqs := ollama.chatRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d chat requests, want 1", len(reqs))
+	}
+	if got, want := fmt.Sprint(reqs[0].Options["stop"]), fmt.Sprint([]any{"</review>", "\n\n\n"}); got != want {
+		t.Errorf("stop = %q, want %q", got, want)
+	}
+}
+
+func TestReviewSubmodules(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		".gitmodules":       "[submodule \"libs/listed\"]\n\tpath = libs/listed\n\turl = https://example.com/listed.git\n",
+		"libs/listed/a.py":  "def listed_func():\n    return 1\n",
+		"libs/gitlink/.git": "gitdir: ../../.git/modules/gitlink\n",
+		"libs/gitlink/b.py": "def gitlink_func():\n    return 1\n",
+		"src/main.py":       "def main_func():\n    return 1\n",
+	})
+	report := reviewEcho(t, dir, nil)
+	if !strings.Contains(report, "main_func") {
+		t.Errorf("regular directory not reviewed:\n%s", report)
+	}
+	for _, name := range []string{"listed_func", "gitlink_func"} {
+		if strings.Contains(report, name) {
+			t.Errorf("submodule %s reviewed by default:\n%s", name, report)
+		}
+	}
+	viper.Set("review_submodules", true)
+	report = runReview(t, dir)
+	for _, name := range []string{"listed_func", "gitlink_func"} {
+		if !strings.Contains(report, name) {
+			t.Errorf("submodule %s not reviewed with review_submodules:\n%s", name, report)
+		}
+	}
+}
+
+func TestReviewCompareModels(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n\n\ndef g():\n    return 2\n"})
+	ollama := newFakeOllama(t, 0)
+	ollama.reply = func(req api.ChatRequest) api.ChatResponse {
+		code := req.Messages[len(req.Messages)-1].Content
+		return api.ChatResponse{Model: req.Model, Done: true, Message: api.Message{Role: "assistant", Content: "review of " + code[:len("def f")] + " by " + req.Model}}
+	}
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "compare_models": []string{"alpha", "beta"}})
+	report := runReview(t, dir)
+	for _, fn := range []string{"f", "g"} {
+		for _, m := range []string{"alpha", "beta"} {
+			if want := fmt.Sprintf("### %s\n\nreview of def %s by %s", m, fn, m); !strings.Contains(report, want) {
+				t.Errorf("report missing %q:\n%s", want, report)
+			}
+		}
+	}
+	if got := ollama.chatModels(); len(got) != 4 {
+		t.Errorf("chat requests by model = %v, want 2 chunks x 2 models", got)
+	}
+}
+
+func TestReviewEchoModelIsOffline(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n"})
+	ollama := newFakeOllama(t, 0)
+	ollama.Close() // 接続を試みれば失敗するホスト
+	templateConfig(t, "Review this {{.lang}}: {{.code}}", map[string]any{"OllamaHost": ollama.URL, "concurrency": concurrencyAuto})
+	if err := ensureModel(); err != nil {
+		t.Fatalf("ensureModel contacted the host for the echo model: %v", err)
+	}
+	report := runReview(t, dir)
+	if !strings.Contains(report, "````text\nReview this py: def f():\n    return 1\n````") {
+		t.Errorf("rendered prompt not returned as the review:\n%s", report)
+	}
+}
+
+func TestReviewRetriesEmptyResponse(t *testing.T) {
+	delay := retryDelay
+	retryDelay = time.Millisecond
+	t.Cleanup(func() { retryDelay = delay })
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.py": "def f():\n    return 1\n"})
+	ollama := newFakeOllama(t, 0)
+	calls := 0
+	ollama.reply = func(req api.ChatRequest) api.ChatResponse {
+		calls++
+		content := "  \n"
+		if calls == 2 {
+			content = "second attempt review"
+		}
+		return api.ChatResponse{Model: req.Model, Done: true, Message: api.Message{Role: "assistant", Content: content}}
+	}
+	echoConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "max_retries": 2})
+	report := runReview(t, dir)
+	if calls != 2 || !strings.Contains(report, "second attempt review") {
+		t.Errorf("empty response not retried (%d calls):\n%s", calls, report)
+	}
+
+	// 再試行しても空なら注記を残す
+	calls = 10
+	report = runReview(t, dir)
+	if calls != 13 || !strings.Contains(report, emptyResponseNote) {
+		t.Errorf("persistently empty response sent %d requests, want 3:\n%s", calls-10, report)
+	}
+
+	// max_retries: 0 でも空の応答は 1 回再試行し、ログにはその上限を示す
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	calls = 0
+	viper.Set("max_retries", 0)
+	runReview(t, dir)
+	if calls != 2 || !strings.Contains(logs.String(), "Retrying f (1/1)") {
+		t.Errorf("empty response with max_retries 0 sent %d requests; log:\n%s", calls, logs.String())
+	}
+}
+
+func TestReviewMaxDepth(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"top.py":         "def depth0():\n    return 0\n",
+		"a/one.py":       "def depth1():\n    return 1\n",
+		"a/b/two.py":     "def depth2():\n    return 2\n",
+		"a/b/c/three.py": "def depth3():\n    return 3\n",
+	})
+	report := reviewEcho(t, dir, map[string]any{"max_depth": 2})
+	for _, name := range []string{"depth0", "depth1", "depth2"} {
+		if !strings.Contains(report, name) {
+			t.Errorf("%s not reviewed:\n%s", name, report)
+		}
+	}
+	if strings.Contains(report, "depth3") {
+		t.Errorf("file deeper than max_depth reviewed:\n%s", report)
+	}
+}
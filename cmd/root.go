@@ -26,13 +26,17 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/ollama/ollama/api"
 	"github.com/spf13/cobra"
@@ -40,6 +44,7 @@ import (
 )
 
 var cfgFile string
+var profile string
 var repository string
 var source string
 
@@ -53,20 +58,38 @@ AI によるレビュー結果を出力するツールです。`,
 		cobra.CheckErr(ensureModel())
 		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 		defer stop()
+		if d := viper.GetDuration("run_timeout"); d > 0 {
+			// 実行全体の期限。期限切れ時は部分的なレポートを書き出して終了する
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
 
 		output := viper.GetString("output")
+		if viper.GetBool("stdout") {
+			output = stdoutPath
+		}
 		var err error
 		if source != "" {
 			err = Review(ctx, source, output)
 		} else {
 			err = Review(ctx, repository, output)
 		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("Run timeout exceeded; partial report written to %s", output)
+			stop()
+			os.Exit(exitCodeTimeout)
+		}
 		if err != nil && !errors.Is(err, context.Canceled) {
 			cobra.CheckErr(err)
 		}
 	},
 }
 
+// exitCodeTimeout は run_timeout の期限切れで終了した際の終了コード。
+// coreutils の timeout コマンドに合わせている。
+const exitCodeTimeout = 124
+
 // Execute は rootCmd にサブコマンドを登録して実行する
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
@@ -79,11 +102,47 @@ func init() {
 
 	// 設定ファイルのパスを指定するフラグ
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "config.yaml", "config file (default is config.yaml)")
+	// 設定ファイルの profiles から適用するプロファイルを選ぶフラグ
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", "", "Apply the named profile from the config's profiles section")
 
 	// レビュー対象リポジトリを指定するフラグ
-	rootCmd.Flags().StringVarP(&repository, "repository", "r", "", "Select code review targets.")
+	rootCmd.Flags().StringVarP(&repository, "repository", "r", "", "Select code review targets (a directory, a file, or a .zip/.tar.gz archive).")
 	// 個別のソースファイルを指定するフラグ
 	rootCmd.Flags().StringVarP(&source, "source", "s", "", "Specify single source file for review")
+	// 出力先を指定するフラグ（"-" で標準出力）
+	rootCmd.Flags().StringP("output", "o", "", "Report output path (\"-\" writes to stdout)")
+	viper.BindPFlag("output", rootCmd.Flags().Lookup("output"))
+	rootCmd.Flags().Bool("stdout", false, "Write the report to stdout instead of a file")
+	viper.BindPFlag("stdout", rootCmd.Flags().Lookup("stdout"))
+	// 既存レポートへ追記するフラグ
+	rootCmd.Flags().Bool("append", false, "Append a dated section to the existing report instead of overwriting it")
+	viper.BindPFlag("append", rootCmd.Flags().Lookup("append"))
+	// 実行全体のタイムアウトを指定するフラグ
+	rootCmd.Flags().Duration("run-timeout", 0, "Deadline for the whole run (e.g. 30m); writes a partial report when exceeded")
+	viper.BindPFlag("run_timeout", rootCmd.Flags().Lookup("run-timeout"))
+	// レビュー対象の言語キー（拡張子）を絞り込むフラグ。AutomaticEnv が
+	// シェルの LANG を拾わないよう、設定キーは languages とする
+	rootCmd.Flags().StringSlice("lang", nil, "Restrict review to these language keys (e.g. py,go)")
+	viper.BindPFlag("languages", rootCmd.Flags().Lookup("lang"))
+	// スナップショット比較向けにレポートを再現可能にするフラグ
+	rootCmd.Flags().Bool("deterministic", false, "Omit timestamps and use fixed seed/temperature so reports are byte-stable")
+	viper.BindPFlag("deterministic", rootCmd.Flags().Lookup("deterministic"))
+	// モデルの生の応答を保存するディレクトリを指定するフラグ
+	rootCmd.Flags().String("save-raw", "", "Directory to write each chunk's raw model response to")
+	viper.BindPFlag("save_raw", rootCmd.Flags().Lookup("save-raw"))
+	// 中断した実行を state_file から再開するフラグ
+	rootCmd.Flags().Bool("resume", false, "Skip chunks already recorded as done in state_file and reuse their sections")
+	viper.BindPFlag("resume", rootCmd.Flags().Lookup("resume"))
+	// 解析できないファイルを実行の失敗として扱うフラグ
+	rootCmd.Flags().Bool("strict-parse", false, "Fail the run when a target file cannot be parsed or contains syntax errors")
+	viper.BindPFlag("strict_parse", rootCmd.Flags().Lookup("strict-parse"))
+	// unified diff の変更箇所に重なる関数だけをレビューするフラグ
+	rootCmd.Flags().String("patch", "", "Review only functions overlapping the changes in this unified diff file")
+	viper.BindPFlag("patch", rootCmd.Flags().Lookup("patch"))
+	// 基準ブランチとの差分に重なる関数だけをレビューするフラグ
+	rootCmd.Flags().String("diff", "", "Review only functions changed relative to a base branch (--diff=<branch>; auto-detected from origin/HEAD when given without a value)")
+	rootCmd.Flags().Lookup("diff").NoOptDefVal = diffAutoBase
+	viper.BindPFlag("diff", rootCmd.Flags().Lookup("diff"))
 }
 
 // initConfig は設定ファイルと環境変数を読み込む
@@ -109,45 +168,336 @@ func initConfig() {
 	if err := viper.ReadInConfig(); err == nil {
 		log.Printf("Using config file: %s", viper.ConfigFileUsed())
 	}
+	cobra.CheckErr(applyProfile(profile))
+	cobra.CheckErr(expandEnvConfig())
+}
+
+// applyProfile は profiles.<name> の設定を基本設定の上に重ねる。設定ファイルの
+// 値として統合するため、コマンドラインフラグの指定はプロファイルより優先される。
+func applyProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+	sub := viper.Sub("profiles." + name)
+	if sub == nil {
+		return fmt.Errorf("profile %q not found in config profiles", name)
+	}
+	if err := viper.MergeConfigMap(sub.AllSettings()); err != nil {
+		return fmt.Errorf("apply profile %q: %w", name, err)
+	}
+	log.Printf("Using profile: %s", name)
+	return nil
+}
+
+// envRef は設定値の中で環境変数を参照する ${VAR} の形式。$VAR や単独の "$" は
+// プロンプトや正規表現、パスワードの一部でありうるため展開しない。
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnvConfig は文字列設定値に含まれる ${VAR} を環境変数で展開する。
+// それ以外の "$" はそのまま残す。展開した値は設定ファイルの値として統合する
+// ため、コマンドラインフラグや環境変数による指定は引き続き優先される。
+// 参照した環境変数が未設定の場合は空文字に置き換えず、エラーを返す。
+func expandEnvConfig() error {
+	expanded := map[string]any{}
+	for _, key := range viper.AllKeys() {
+		v, ok := viper.Get(key).(string)
+		if !ok || !envRef.MatchString(v) {
+			continue
+		}
+		var missing []string
+		v = envRef.ReplaceAllStringFunc(v, func(ref string) string {
+			name := envRef.FindStringSubmatch(ref)[1]
+			val, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return val
+		})
+		if len(missing) > 0 {
+			return fmt.Errorf("config %s: environment variable %s is not set", key, strings.Join(missing, ", "))
+		}
+		// MergeConfigMap はネストしたマップを受け取るため、キーを "." で分けて格納する
+		m := expanded
+		parts := strings.Split(key, ".")
+		for _, p := range parts[:len(parts)-1] {
+			sub, ok := m[p].(map[string]any)
+			if !ok {
+				sub = map[string]any{}
+				m[p] = sub
+			}
+			m = sub
+		}
+		m[parts[len(parts)-1]] = v
+	}
+	if len(expanded) == 0 {
+		return nil
+	}
+	if err := viper.MergeConfigMap(expanded); err != nil {
+		return fmt.Errorf("expand config: %w", err)
+	}
+	return nil
+}
+
+// newOllamaClient は設定の OllamaHost に接続する Ollama クライアントを生成する。
+func newOllamaClient() (*api.Client, error) {
+	baseURL, err := url.Parse(viper.GetString("OllamaHost"))
+	if err != nil {
+		return nil, fmt.Errorf("parse OllamaHost: %w", err)
+	}
+	return api.NewClient(baseURL, newHTTPClient(nil)), nil
+}
+
+// newEndpointClient は host に接続し、各リクエストに headers を付与する
+// Ollama クライアントを生成する。model_routing のルールごとに別の
+// エンドポイントや認証情報を使うために用いる。
+func newEndpointClient(host string, headers map[string]string) (*api.Client, error) {
+	baseURL, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("parse host %q: %w", host, err)
+	}
+	return api.NewClient(baseURL, newHTTPClient(headers)), nil
+}
+
+// version はビルド時に -ldflags "-X ollama_review/cmd.version=..." で埋め込む
+// バージョン。User-Agent に用いる。
+var version = "dev"
+
+// userAgent は Ollama へのリクエストに付ける User-Agent を返す。共有サーバの
+// アクセスログで本ツールを識別できるよう、既定では "ollama_review/<version>"
+// とする。user_agent に空文字を指定すると Ollama クライアントの既定値を使う。
+func userAgent() string {
+	if viper.IsSet("user_agent") {
+		return viper.GetString("user_agent")
+	}
+	return "ollama_review/" + version
+}
+
+// headerTransport は送信する各リクエストに固定のヘッダを付与する。
+type headerTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTripper は元のリクエストを変更してはならないため複製してから設定する
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// newHTTPClient は Ollama との通信に使う HTTP クライアントを生成する。
+// http.DefaultTransport を基に、設定された接続プールとタイムアウトを適用し、
+// 各リクエストに User-Agent と headers を付与する。headers に User-Agent が
+// あればそちらを優先する。応答はストリーミングされるため、クライアント全体の
+// タイムアウトは設けない。
+func newHTTPClient(headers map[string]string) *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if n := viper.GetInt("max_idle_conns_per_host"); n > 0 {
+		tr.MaxIdleConnsPerHost = n
+		if tr.MaxIdleConns < n {
+			tr.MaxIdleConns = n
+		}
+	}
+	if d := viper.GetDuration("idle_conn_timeout"); d > 0 {
+		tr.IdleConnTimeout = d
+	}
+	if d := viper.GetDuration("tls_handshake_timeout"); d > 0 {
+		tr.TLSHandshakeTimeout = d
+	}
+	if d := viper.GetDuration("response_header_timeout"); d > 0 {
+		tr.ResponseHeaderTimeout = d
+	}
+	dialTimeout := viper.GetDuration("dial_timeout")
+	keepAlive := viper.GetDuration("keep_alive")
+	if dialTimeout > 0 || keepAlive != 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		if dialTimeout > 0 {
+			dialer.Timeout = dialTimeout
+		}
+		if keepAlive != 0 {
+			// 負の値を指定すると keep-alive を無効化できる
+			dialer.KeepAlive = keepAlive
+		}
+		tr.DialContext = dialer.DialContext
+	}
+	set := map[string]string{}
+	if ua := userAgent(); ua != "" {
+		set["User-Agent"] = ua
+	}
+	for k, v := range headers {
+		set[http.CanonicalHeaderKey(k)] = v
+	}
+	if len(set) == 0 {
+		return &http.Client{Transport: tr}
+	}
+	return &http.Client{Transport: &headerTransport{base: tr, headers: set}}
 }
 
-// ensureModel checks if the model configured in "model" exists locally.
-// If the model is missing, it prompts the user to download it using the
-// Ollama API. When the user declines, an error is returned and the
-// application exits via cobra.CheckErr.
+// ensureModel checks if the model configured in "model", and every model
+// named in "model_routing" or "compare_models", exists on the Ollama host it
+// will be sent to. Routes with their own host or headers are checked against
+// that endpoint, so the same model served from two hosts is checked on both.
+// A compare model uses the endpoint of the first route naming it, as the
+// review itself does.
+// If a model is missing, "pull_policy" decides what happens: by default it
+// prompts the user to download it using the Ollama API. When the user
+// declines, an error is returned and the application exits via
+// cobra.CheckErr.
 func ensureModel() error {
 	model := viper.GetString("model")
 	if model == "" {
 		return fmt.Errorf("model is not specified")
 	}
-	baseURL, err := url.Parse(viper.GetString("OllamaHost"))
+	client, err := newOllamaClient()
 	if err != nil {
-		return fmt.Errorf("parse OllamaHost: %w", err)
+		return err
 	}
-	client := api.NewClient(baseURL, http.DefaultClient)
-	list, err := client.List(context.Background())
+	routes, err := loadModelRoutes()
 	if err != nil {
-		return fmt.Errorf("list models: %w", err)
+		return err
 	}
-	for _, m := range list.Models {
-		if m.Name == model {
-			return nil
+	if err := connectRoutes(routes); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	type target struct {
+		client *api.Client
+		model  string
+	}
+	var targets []target
+	for _, r := range append([]modelRoute{{Model: model}}, routes...) {
+		c := client
+		if r.client != nil {
+			c = r.client
+		}
+		t := target{c, r.Model}
+		if !slices.Contains(targets, t) {
+			targets = append(targets, t)
 		}
 	}
-	fmt.Printf("Model %s not found. Pull now? [y/N]: ", model)
-	var ans string
-	fmt.Scanln(&ans)
-	if strings.ToLower(strings.TrimSpace(ans)) != "y" {
-		return fmt.Errorf("required model %s not available", model)
+	for _, m := range viper.GetStringSlice("compare_models") {
+		t := target{client, m}
+		for _, r := range routes {
+			if r.Model == m && r.client != nil {
+				t.client = r.client
+				break
+			}
+		}
+		if !slices.Contains(targets, t) {
+			targets = append(targets, t)
+		}
 	}
-	err = client.Pull(context.Background(), &api.PullRequest{Name: model}, func(pr api.ProgressResponse) error {
-		if pr.Status != "" {
-			log.Println(pr.Status)
+	for _, t := range targets {
+		if t.model == echoModel {
+			// The built-in echo model never talks to Ollama.
+			continue
 		}
+		if err := ensureModelOn(ctx, t.client, t.model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureModelOn makes sure model is available through client, pulling it
+// according to "pull_policy" when it is missing.
+func ensureModelOn(ctx context.Context, client *api.Client, model string) error {
+	ok, err := hasModel(ctx, client, model)
+	if err != nil {
+		return err
+	}
+	if ok {
 		return nil
-	})
+	}
+	switch policy := viper.GetString("pull_policy"); policy {
+	case "", pullPolicyPrompt:
+		fmt.Printf("Model %s not found. Pull now? [y/N]: ", model)
+		var ans string
+		fmt.Scanln(&ans)
+		if strings.ToLower(strings.TrimSpace(ans)) != "y" {
+			return fmt.Errorf("required model %s not available", model)
+		}
+	case pullPolicyAlways:
+		log.Printf("Model %s not found; pulling (pull_policy: always)", model)
+	case pullPolicyNever:
+		return fmt.Errorf("required model %s not available and pull_policy is never", model)
+	default:
+		return fmt.Errorf("invalid pull_policy %q (want prompt, always or never)", policy)
+	}
+	if err := pullModel(ctx, client, model); err != nil {
+		return err
+	}
+	// Make sure the pull actually produced the model before continuing.
+	ok, err = hasModel(ctx, client, model)
 	if err != nil {
-		return fmt.Errorf("pull model: %w", err)
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("model %s still not available after pull", model)
 	}
 	return nil
 }
+
+// Values accepted by "pull_policy". prompt asks before pulling a missing
+// model, always pulls without asking and never fails immediately, which
+// suits non-interactive runs such as CI.
+const (
+	pullPolicyPrompt = "prompt"
+	pullPolicyAlways = "always"
+	pullPolicyNever  = "never"
+)
+
+// hasModel reports whether model is present in the local model list.
+func hasModel(ctx context.Context, client *api.Client, model string) (bool, error) {
+	list, err := client.List(ctx)
+	if err != nil {
+		return false, fmt.Errorf("list models: %w", err)
+	}
+	for _, m := range list.Models {
+		if m.Name == model {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// pullBackoff is the wait before the first pull retry; it doubles after
+// each further failure.
+var pullBackoff = 2 * time.Second
+
+// pullModel downloads model, retrying with exponential backoff when the
+// pull is interrupted. Ollama keeps already downloaded layers, so each
+// retry resumes where the previous attempt stopped. The number of
+// attempts is taken from "pull_retries" (default 3).
+func pullModel(ctx context.Context, client *api.Client, model string) error {
+	attempts := viper.GetInt("pull_retries")
+	if attempts < 1 {
+		attempts = 3
+	}
+	backoff := pullBackoff
+	var err error
+	for i := 1; i <= attempts; i++ {
+		err = client.Pull(ctx, &api.PullRequest{Name: model}, func(pr api.ProgressResponse) error {
+			if pr.Status != "" {
+				log.Println(pr.Status)
+			}
+			return nil
+		})
+		if err == nil {
+			return nil
+		}
+		if i == attempts {
+			break
+		}
+		log.Printf("Pull attempt %d/%d failed: %v; retrying in %s", i, attempts, err, backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("pull model %s failed after %d attempts: %w", model, attempts, err)
+}
@@ -0,0 +1,311 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// readConfig は YAML の設定を設定ファイルとして読み込む。
+func readConfig(t *testing.T, yaml string) {
+	t.Helper()
+	resetConfig(t, nil)
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(yaml)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpandEnvConfigUsesExpandedHost(t *testing.T) {
+	var hit bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = r.URL.Path == "/api/version"
+		w.Write([]byte(`{"version":"0.0.0"}`))
+	}))
+	defer srv.Close()
+	t.Setenv("TEST_OLLAMA_HOST", srv.URL)
+	readConfig(t, "OllamaHost: ${TEST_OLLAMA_HOST}\nmodel: literal\n")
+	if err := expandEnvConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := viper.GetString("model"); got != "literal" {
+		t.Errorf("literal value changed to %q", got)
+	}
+	client, err := newOllamaClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Version(t.Context()); err != nil || !hit {
+		t.Errorf("client did not reach the expanded host %s: %v", srv.URL, err)
+	}
+}
+
+func TestExpandEnvConfigKeepsFlagPrecedence(t *testing.T) {
+	t.Setenv("TEST_MODEL", "from-config")
+	readConfig(t, "model: ${TEST_MODEL}\n")
+	flags := (&cobra.Command{}).Flags()
+	flags.String("model", "", "")
+	viper.BindPFlag("model", flags.Lookup("model"))
+	if err := expandEnvConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := viper.GetString("model"); got != "from-config" {
+		t.Errorf("model = %q, want the expanded config value", got)
+	}
+	// 展開後に指定したフラグも設定ファイルの値より優先される
+	flags.Set("model", "from-flag")
+	if got := viper.GetString("model"); got != "from-flag" {
+		t.Errorf("model = %q, want the flag value", got)
+	}
+}
+
+func TestExpandEnvConfigOnlyBracedReferences(t *testing.T) {
+	t.Setenv("TEST_TOKEN", "secret")
+	readConfig(t, "token: Bearer ${TEST_TOKEN}\npassword: pa$$word\nregex: ^v\\d+$\nprompt: costs $5 or $TEST_TOKEN\n")
+	if err := expandEnvConfig(); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"token":    "Bearer secret",
+		"password": "pa$$word",
+		"regex":    `^v\d+$`,
+		"prompt":   "costs $5 or $TEST_TOKEN",
+	} {
+		if got := viper.GetString(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+
+	// 未設定の環境変数は空文字にせずエラーにする
+	readConfig(t, "guideline: ${TEST_UNSET_VAR}/g.md\n")
+	if err := expandEnvConfig(); err == nil || !strings.Contains(err.Error(), "TEST_UNSET_VAR") || !strings.Contains(err.Error(), "guideline") {
+		t.Errorf("expandEnvConfig = %v, want an error naming the key and the unset variable", err)
+	}
+}
+
+func TestEnsureModelRetriesInterruptedPull(t *testing.T) {
+	ollama := newFakeOllama(t, 0)
+	ollama.pullFailures = 1
+	backoff := pullBackoff
+	pullBackoff = time.Millisecond
+	t.Cleanup(func() { pullBackoff = backoff })
+	resetConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "pull_policy": pullPolicyAlways})
+	if err := ensureModel(); err != nil {
+		t.Fatalf("ensureModel = %v, want success on the second pull", err)
+	}
+	if ollama.pulls != 2 {
+		t.Errorf("pulled %d times, want 2", ollama.pulls)
+	}
+
+	// 失敗が続く場合は試行回数を添えたエラーにする
+	ollama = newFakeOllama(t, 0)
+	ollama.pullFailures = 5
+	resetConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "pull_policy": pullPolicyAlways, "pull_retries": 2})
+	if err := ensureModel(); err == nil || !strings.Contains(err.Error(), "after 2 attempts") {
+		t.Errorf("ensureModel = %v, want failure after 2 attempts", err)
+	}
+}
+
+func TestNewHTTPClientAppliesTransportSettings(t *testing.T) {
+	resetConfig(t, map[string]any{
+		"max_idle_conns_per_host": 32,
+		"idle_conn_timeout":       "45s",
+		"response_header_timeout": "50ms",
+	})
+	client := newHTTPClient(nil)
+	ht, ok := client.Transport.(*headerTransport)
+	if !ok {
+		t.Fatalf("transport = %T, want *headerTransport", client.Transport)
+	}
+	tr := ht.base.(*http.Transport)
+	if tr.MaxIdleConnsPerHost != 32 || tr.MaxIdleConns < 32 {
+		t.Errorf("MaxIdleConnsPerHost = %d, MaxIdleConns = %d, want 32", tr.MaxIdleConnsPerHost, tr.MaxIdleConns)
+	}
+	if tr.IdleConnTimeout != 45*time.Second || tr.ResponseHeaderTimeout != 50*time.Millisecond {
+		t.Errorf("IdleConnTimeout = %v, ResponseHeaderTimeout = %v", tr.IdleConnTimeout, tr.ResponseHeaderTimeout)
+	}
+
+	// Review が使う Ollama クライアントにも同じ設定が効く
+	ollama := newFakeOllama(t, 200*time.Millisecond)
+	viper.Set("OllamaHost", ollama.URL)
+	oc, err := newOllamaClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := false
+	err = oc.Chat(context.Background(), &api.ChatRequest{Model: "fake", Messages: []api.Message{{Role: "user", Content: "hi"}}, Stream: &stream}, func(api.ChatResponse) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Chat = %v, want a response header timeout", err)
+	}
+}
+
+func TestApplyProfileOverridesBaseConfig(t *testing.T) {
+	const config = `
+model: base-model
+guideline: base.tmpl
+max_retries: 1
+profiles:
+  strict:
+    model: big-model
+    guideline: strict.tmpl
+  quick:
+    model: small-model
+    max_retries: 0
+`
+	for _, tt := range []struct {
+		profile, model, guideline string
+		retries                   int
+	}{
+		{"", "base-model", "base.tmpl", 1},
+		{"strict", "big-model", "strict.tmpl", 1},
+		{"quick", "small-model", "base.tmpl", 0},
+	} {
+		readConfig(t, config)
+		if err := applyProfile(tt.profile); err != nil {
+			t.Fatal(err)
+		}
+		if got := viper.GetString("model"); got != tt.model {
+			t.Errorf("profile %q: model = %q, want %q", tt.profile, got, tt.model)
+		}
+		if got := viper.GetString("guideline"); got != tt.guideline {
+			t.Errorf("profile %q: guideline = %q, want %q", tt.profile, got, tt.guideline)
+		}
+		if got := viper.GetInt("max_retries"); got != tt.retries {
+			t.Errorf("profile %q: max_retries = %d, want %d", tt.profile, got, tt.retries)
+		}
+	}
+	if err := applyProfile("missing"); err == nil || !strings.Contains(err.Error(), `"missing"`) {
+		t.Errorf("applyProfile(missing) = %v, want a not-found error", err)
+	}
+}
+
+func TestEnsureModelPullPolicies(t *testing.T) {
+	// answer を標準入力として prompt の問い合わせに答える
+	withStdin := func(t *testing.T, answer string) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteString(answer)
+		w.Close()
+		stdin := os.Stdin
+		os.Stdin = r
+		t.Cleanup(func() { os.Stdin = stdin; r.Close() })
+	}
+	for _, tt := range []struct {
+		policy, answer string
+		pulls          int
+		wantErr        string
+	}{
+		{pullPolicyNever, "", 0, "pull_policy is never"},
+		{pullPolicyAlways, "", 1, ""},
+		{pullPolicyPrompt, "y\n", 1, ""},
+		{pullPolicyPrompt, "n\n", 0, "not available"},
+		{"", "\n", 0, "not available"},
+		{"sometimes", "", 0, "invalid pull_policy"},
+	} {
+		t.Run(tt.policy+"/"+strings.TrimSpace(tt.answer), func(t *testing.T) {
+			ollama := newFakeOllama(t, 0)
+			resetConfig(t, map[string]any{"model": "fake", "OllamaHost": ollama.URL, "pull_policy": tt.policy})
+			withStdin(t, tt.answer)
+			err := ensureModel()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("ensureModel = %v, want error %q", err, tt.wantErr)
+			}
+			if ollama.pulls != tt.pulls {
+				t.Errorf("pulled %d times, want %d", ollama.pulls, tt.pulls)
+			}
+		})
+	}
+}
+
+func TestEnsureModelChecksCompareModels(t *testing.T) {
+	ollama := newFakeOllama(t, 0)
+	ollama.sizes["fake"] = "7B"
+	settings := map[string]any{"model": "fake", "OllamaHost": ollama.URL, "compare_models": []string{"fake", "other"}}
+
+	settings["pull_policy"] = pullPolicyNever
+	resetConfig(t, settings)
+	if err := ensureModel(); err == nil || !strings.Contains(err.Error(), "other") {
+		t.Errorf("ensureModel = %v, want an error for the missing compare model", err)
+	}
+
+	settings["pull_policy"] = pullPolicyAlways
+	resetConfig(t, settings)
+	if err := ensureModel(); err != nil {
+		t.Fatalf("ensureModel = %v", err)
+	}
+	if ollama.pulls != 1 {
+		t.Errorf("pulled %d times, want 1 for the missing compare model", ollama.pulls)
+	}
+}
+
+func TestReviewSendsUserAgent(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.py": "def small():\n    return 1\n\n\ndef large():\n    return '" + strings.Repeat("x", 200) + "'\n",
+	})
+	agents := func(settings map[string]any) map[string]string {
+		t.Helper()
+		ollama := newFakeOllama(t, 0)
+		settings["model"] = "fake"
+		settings["OllamaHost"] = ollama.URL
+		echoConfig(t, settings)
+		runReview(t, dir)
+		got := map[string]string{}
+		reqs, headers := ollama.chatRequests(), ollama.chatHeaders()
+		for i, req := range reqs {
+			code := req.Messages[len(req.Messages)-1].Content
+			got[code[:strings.Index(code, "(")]] = headers[i].Get("User-Agent")
+		}
+		return got
+	}
+
+	def := "ollama_review/" + version
+	if got, want := agents(map[string]any{}), map[string]string{"def small": def, "def large": def}; !maps.Equal(got, want) {
+		t.Errorf("default User-Agent = %v, want %v", got, want)
+	}
+	if got, want := agents(map[string]any{"user_agent": "ci-review/2"}), map[string]string{"def small": "ci-review/2", "def large": "ci-review/2"}; !maps.Equal(got, want) {
+		t.Errorf("configured User-Agent = %v, want %v", got, want)
+	}
+	// ルールの headers に User-Agent があればそちらを優先する。
+	got := agents(map[string]any{
+		"user_agent": "ci-review/2",
+		"model_routing": []map[string]any{
+			{"min_bytes": 100, "model": "big", "headers": map[string]string{"User-Agent": "gateway/1"}},
+		},
+	})
+	if want := map[string]string{"def small": "ci-review/2", "def large": "gateway/1"}; !maps.Equal(got, want) {
+		t.Errorf("routed User-Agent = %v, want %v", got, want)
+	}
+}
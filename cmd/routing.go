@@ -0,0 +1,109 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/spf13/viper"
+)
+
+// modelRoute は model_routing の 1 ルール。拡張子とチャンクサイズの条件が
+// すべて一致した場合に Model が使われる。未指定の条件は常に一致とみなす。
+// Host と Headers を指定すると、そのモデルへの要求は OllamaHost の代わりに
+// Host へ送られ、Headers が付与される。値の ${VAR} は環境変数で展開する。
+type modelRoute struct {
+	Ext      string            `mapstructure:"ext"`       // 例: ".py"
+	MinBytes int               `mapstructure:"min_bytes"` // この値以上のチャンク
+	MaxBytes int               `mapstructure:"max_bytes"` // この値以下のチャンク
+	Model    string            `mapstructure:"model"`
+	Host     string            `mapstructure:"host"`
+	Headers  map[string]string `mapstructure:"headers"`
+
+	client *api.Client // Host または Headers を指定したルールのクライアント
+}
+
+// loadModelRoutes は設定から model_routing のルール群を読み込む。
+func loadModelRoutes() ([]modelRoute, error) {
+	var routes []modelRoute
+	if err := viper.UnmarshalKey("model_routing", &routes); err != nil {
+		return nil, fmt.Errorf("parse model_routing: %w", err)
+	}
+	for i, r := range routes {
+		if r.Model == "" {
+			return nil, fmt.Errorf("model_routing[%d]: model is required", i)
+		}
+	}
+	return routes, nil
+}
+
+// connectRoutes は Host または Headers を持つルールごとにクライアントを生成する。
+// 同じモデルでもルールごとに別のエンドポイントや認証情報を使える。
+func connectRoutes(routes []modelRoute) error {
+	for i, r := range routes {
+		if r.Host == "" && len(r.Headers) == 0 {
+			continue
+		}
+		host := os.ExpandEnv(r.Host)
+		if host == "" {
+			host = viper.GetString("OllamaHost")
+		}
+		headers := make(map[string]string, len(r.Headers))
+		for k, v := range r.Headers {
+			headers[k] = os.ExpandEnv(v)
+		}
+		c, err := newEndpointClient(host, headers)
+		if err != nil {
+			return fmt.Errorf("model_routing[%d]: %w", i, err)
+		}
+		routes[i].client = c
+	}
+	return nil
+}
+
+// matches はルールが拡張子 ext、サイズ size のチャンクに適用されるかを判定する。
+func (r modelRoute) matches(ext string, size int) bool {
+	if r.Ext != "" && !strings.EqualFold("."+strings.TrimPrefix(r.Ext, "."), ext) {
+		return false
+	}
+	if r.MinBytes > 0 && size < r.MinBytes {
+		return false
+	}
+	if r.MaxBytes > 0 && size > r.MaxBytes {
+		return false
+	}
+	return true
+}
+
+// selectRoute は先頭から順にルールを評価し、最初に一致したルールを返す。
+// 一致するルールがなければ既定のモデル def だけを持つルールを返す。
+func selectRoute(routes []modelRoute, def, ext string, size int) modelRoute {
+	for _, r := range routes {
+		if r.matches(ext, size) {
+			return r
+		}
+	}
+	return modelRoute{Model: def}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// routedHosts は同じモデル shared を .py と .go で別のホストへ送る設定を返す。
+func routedHosts(def, py, goHost *fakeOllama) map[string]any {
+	return map[string]any{
+		"model":      "fake",
+		"OllamaHost": def.URL,
+		"model_routing": []map[string]any{
+			{"ext": ".py", "model": "shared", "host": py.URL},
+			{"ext": ".go", "model": "shared", "host": goHost.URL},
+		},
+	}
+}
+
+func TestReviewRoutesSameModelToEachRouteHost(t *testing.T) {
+	def, py, goHost := newFakeOllama(t, 0), newFakeOllama(t, 0), newFakeOllama(t, 0)
+	dir := t.TempDir()
+	writeTree(t, dir, mixedFixture)
+	report := reviewEcho(t, dir, routedHosts(def, py, goHost))
+	if !strings.Contains(report, "py_func") || !strings.Contains(report, "GoFunc") {
+		t.Fatalf("chunks not reviewed:\n%s", report)
+	}
+	for name, tt := range map[string]struct {
+		host *fakeOllama
+		want []string
+	}{
+		"default": {def, nil},
+		".py":     {py, []string{"shared"}},
+		".go":     {goHost, []string{"shared"}},
+	} {
+		if got := tt.host.chatModels(); !slices.Equal(got, tt.want) {
+			t.Errorf("%s host received %v, want %v", name, got, tt.want)
+		}
+	}
+}
+
+func TestEnsureModelChecksEachRouteHost(t *testing.T) {
+	def, py, goHost := newFakeOllama(t, 0), newFakeOllama(t, 0), newFakeOllama(t, 0)
+	def.sizes["fake"] = "7B"
+	py.sizes["shared"] = "7B"
+	settings := routedHosts(def, py, goHost)
+	settings["pull_policy"] = pullPolicyNever
+	resetConfig(t, settings)
+	if err := ensureModel(); err == nil || !strings.Contains(err.Error(), "shared") {
+		t.Errorf("ensureModel = %v, want an error for shared missing on the .go host", err)
+	}
+	goHost.sizes["shared"] = "7B"
+	if err := ensureModel(); err != nil {
+		t.Errorf("ensureModel = %v with every model installed", err)
+	}
+}
+
+func TestReviewRoutesChunksBySize(t *testing.T) {
+	ollama := newFakeOllama(t, 0)
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.py": "def small():\n    return 1\n\n\ndef large():\n    return '" + strings.Repeat("x", 200) + "'\n",
+	})
+	echoConfig(t, map[string]any{
+		"model":      "fake",
+		"OllamaHost": ollama.URL,
+		"model_routing": []map[string]any{
+			{"min_bytes": 100, "model": "big"},
+			{"max_bytes": 99, "model": "tiny"},
+		},
+	})
+	runReview(t, dir)
+	got := map[string]string{}
+	for _, req := range ollama.chatRequests() {
+		code := req.Messages[len(req.Messages)-1].Content
+		got[code[:strings.Index(code, "(")]] = req.Model
+	}
+	if want := map[string]string{"def small": "tiny", "def large": "big"}; !maps.Equal(got, want) {
+		t.Errorf("models by chunk = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var serveAddr string
+
+// serveCmd はレビュー機能を HTTP API として公開するサブコマンド
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "レビューを HTTP API として提供する",
+	Long: `POST /review でコード片を受け付け、Ollama によるレビュー結果を
+JSON で返す HTTP サーバを起動します。`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cobra.CheckErr(ensureModel())
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		h, err := newReviewHandler()
+		cobra.CheckErr(err)
+		cobra.CheckErr(serve(ctx, serveAddr, newServeMux(h)))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+
+	// 待ち受けアドレスを指定するフラグ
+	serveCmd.Flags().StringVar(&serveAddr, "addr", ":8080", "Address to listen on")
+}
+
+// reviewRequest は POST /review のリクエストボディ。
+// Guideline を指定した場合は設定のガイドラインの代わりに使用する。
+type reviewRequest struct {
+	Language  string `json:"language"`
+	Code      string `json:"code"`
+	Guideline string `json:"guideline,omitempty"`
+}
+
+// reviewResponse は POST /review のレスポンスボディ。
+type reviewResponse struct {
+	Model    string `json:"model"`
+	Language string `json:"language"`
+	Review   string `json:"review"`
+}
+
+// reviewHandler は共有の Ollama クライアントを用いてレビュー要求を処理する。
+type reviewHandler struct {
+	client    *api.Client
+	model     string
+	guideline *template.Template
+	options   map[string]any // Ollama へ渡すモデルオプション（chatOptions）
+}
+
+// newReviewHandler は設定からクライアントとガイドラインを準備してハンドラを生成する。
+func newReviewHandler() (*reviewHandler, error) {
+	if err := validateTruncation(); err != nil {
+		return nil, err
+	}
+	guideline, err := loadGuideline("guideline", viper.GetStringSlice("guideline_partials"))
+	if err != nil {
+		return nil, err
+	}
+	client, err := newOllamaClient()
+	if err != nil {
+		return nil, err
+	}
+	// 要求ごとの再現性は求めないため、seed は設定されている場合だけ渡す
+	var seed *int
+	if viper.IsSet("seed") {
+		n := viper.GetInt("seed")
+		seed = &n
+	}
+	return &reviewHandler{client: client, model: viper.GetString("model"), guideline: guideline, options: chatOptions(seed)}, nil
+}
+
+// newServeMux は serve モードのルーティングを定義する。
+func newServeMux(h *reviewHandler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("POST /review", h)
+	return mux
+}
+
+// defaultMaxRequestBytes は max_file_bytes も max_prompt_bytes も未指定のときの
+// POST /review のボディの上限。
+const defaultMaxRequestBytes = 16 << 20
+
+// requestOverheadBytes はボディの上限に加える、ガイドラインや JSON のエスケープの分。
+const requestOverheadBytes = 64 << 10
+
+// codeLimit は受け付けるコードの上限バイト数を返す。max_file_bytes を優先し、
+// 未指定なら max_prompt_bytes を用いる。どちらも未指定なら 0（無制限）。
+func codeLimit() int64 {
+	if limit := viper.GetInt64("max_file_bytes"); limit > 0 {
+		return limit
+	}
+	return viper.GetInt64("max_prompt_bytes")
+}
+
+// ServeHTTP は JSON のコード片を受け取り、レビュー結果を返す。Accept ヘッダに
+// 応じて JSON（既定）または Markdown で応答する。ボディとコードの大きさは
+// codeLimit に基づいて制限する。
+func (h *reviewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limit := codeLimit()
+	bodyLimit := int64(defaultMaxRequestBytes)
+	if limit > 0 {
+		// JSON のエスケープで長くなる分を見込み、コードの上限の 2 倍まで読む
+		bodyLimit = 2*limit + requestOverheadBytes
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, bodyLimit)
+	var req reviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("request body exceeds %d bytes", bodyLimit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Language == "" || req.Code == "" {
+		http.Error(w, "language and code are required", http.StatusBadRequest)
+		return
+	}
+	if limit > 0 && int64(len(req.Code)) > limit {
+		http.Error(w, fmt.Sprintf("code is %d bytes; limit is %d", len(req.Code), limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	guideline := h.guideline
+	if req.Guideline != "" {
+		tmpl, err := template.New("guideline").Parse(req.Guideline)
+		if err != nil {
+			http.Error(w, "parse guideline: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		guideline = tmpl
+	}
+
+	res, err := reviewChunk(r.Context(), h.client, h.model, guideline, req.Language, Chunk{Name: "snippet", Code: []byte(req.Code)}, h.options)
+	var tooLarge *PromptTooLargeError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		log.Printf("Review error: %v", err)
+		http.Error(w, "review failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if negotiateType(r.Header.Get("Accept")) == mediaMarkdown {
+		w.Header().Set("Content-Type", mediaMarkdown+"; charset=utf-8")
+		if _, err := io.WriteString(w, res.Markdown()); err != nil {
+			log.Printf("Write response error: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", mediaJSON)
+	if err := json.NewEncoder(w).Encode(reviewResponse{Model: h.model, Language: req.Language, Review: res.Markdown()}); err != nil {
+		log.Printf("Write response error: %v", err)
+	}
+}
+
+// POST /review が返せる応答の形式。
+const (
+	mediaJSON     = "application/json"
+	mediaMarkdown = "text/markdown"
+)
+
+// negotiateType は Accept ヘッダから応答の形式を選ぶ。q 値が最も高い対応形式を
+// 返し、同じ q 値なら先に書かれたものを優先する。指定がない場合や対応する形式が
+// 含まれない場合は JSON を返す。
+func negotiateType(accept string) string {
+	best, bestQ := mediaJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if mediaType != mediaJSON && mediaType != mediaMarkdown {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok && strings.TrimSpace(k) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = mediaType, q
+		}
+	}
+	return best
+}
+
+// serve は ctx がキャンセルされるまで HTTP サーバを起動し、終了時は処理中の
+// リクエストを待ってからシャットダウンする。
+func serve(ctx context.Context, addr string, handler http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("Listening on %s", addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	log.Printf("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
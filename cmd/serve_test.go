@@ -0,0 +1,127 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// goSnippet は POST /review に送る Go のコード片。
+const goSnippet = "func Add(a, b int) int {\n\treturn a + b\n}"
+
+// postReview は echo モデルのハンドラへ body を POST し、応答を返す。
+func postReview(t *testing.T, body, accept string, settings map[string]any) *httptest.ResponseRecorder {
+	t.Helper()
+	echoConfig(t, settings)
+	h, err := newReviewHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/review", strings.NewReader(body))
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	newServeMux(h).ServeHTTP(rec, req)
+	return rec
+}
+
+// reviewBody は POST /review のリクエストボディを JSON で返す。
+func reviewBody(t *testing.T, language, code string) string {
+	t.Helper()
+	b, err := json.Marshal(reviewRequest{Language: language, Code: code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestReviewHandlerReturnsJSONReview(t *testing.T) {
+	rec := postReview(t, reviewBody(t, "go", goSnippet), "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != mediaJSON {
+		t.Errorf("Content-Type = %q, want %q", ct, mediaJSON)
+	}
+	var res reviewResponse
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Model != echoModel || res.Language != "go" || !strings.Contains(res.Review, "return a + b") {
+		t.Errorf("unexpected response: %+v", res)
+	}
+}
+
+func TestReviewHandlerRejectsBadRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		settings map[string]any
+		want     int
+	}{
+		{"invalid JSON", "{", nil, http.StatusBadRequest},
+		{"missing code", `{"language":"go"}`, nil, http.StatusBadRequest},
+		{"code over max_file_bytes", reviewBody(t, "go", goSnippet), map[string]any{"max_file_bytes": 10}, http.StatusRequestEntityTooLarge},
+		{"body over the limit", reviewBody(t, "go", strings.Repeat("x", 2*requestOverheadBytes)), map[string]any{"max_prompt_bytes": 10}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		if rec := postReview(t, tt.body, "", tt.settings); rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+		}
+	}
+}
+
+func TestReviewHandlerHonorsAccept(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", mediaJSON},
+		{"application/json", mediaJSON},
+		{"text/markdown", mediaMarkdown},
+		{"text/html, text/markdown", mediaMarkdown},
+		{"text/markdown;q=0.5, application/json", mediaJSON},
+		{"application/json;q=0.2, text/markdown;q=0.8", mediaMarkdown},
+		{"text/html", mediaJSON},
+	}
+	for _, tt := range tests {
+		rec := postReview(t, reviewBody(t, "go", goSnippet), tt.accept, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Accept %q: status = %d: %s", tt.accept, rec.Code, rec.Body)
+		}
+		ct := rec.Header().Get("Content-Type")
+		if !strings.HasPrefix(ct, tt.want) {
+			t.Errorf("Accept %q: Content-Type = %q, want %q", tt.accept, ct, tt.want)
+		}
+		body := rec.Body.String()
+		var res reviewResponse
+		isJSON := json.Unmarshal([]byte(body), &res) == nil
+		if isJSON != (tt.want == mediaJSON) || !strings.Contains(body, "return a + b") {
+			t.Errorf("Accept %q: body is not %s:\n%s", tt.accept, tt.want, body)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// chunkID はチャンクを識別する安定したハッシュを返す。root からの相対パス・
+// 名前・空白を正規化したコードから求め、行番号は含めない。そのため周囲の
+// コードが変わって行がずれても、チャンク自身が変わらなければ同じ値になる。
+// 作業ディレクトリや --repository の書き方が変わっても値は変わらない。
+func chunkID(root, path string, fn Chunk) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		// 単一ファイル指定時はファイル名を用いる
+		rel = filepath.Base(path)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", filepath.ToSlash(rel), fn.Name)
+	h.Write([]byte(normalizeCode(fn.Code, chunkLang(filepath.Ext(path), fn))))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// normalizeCode は改行コードや行末・行内の空白の違いだけでは変わらないよう
+// コードを正規化する。Python はインデントが意味を持つため行頭の空白は残す。
+func normalizeCode(code []byte, lang string) string {
+	var lines []string
+	for _, line := range strings.Split(string(normalizeNewlines(code)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		indent := ""
+		if lang == "py" {
+			indent = line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		}
+		lines = append(lines, indent+strings.Join(fields, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// resumeKeys はプロンプトやレポートの節の内容を左右する設定。いずれかが
+// 変わった場合は state_file の記録を再利用しない。
+var resumeKeys = []string{
+	"model", "model_routing", "compare_models", "batch_size", "review_language",
+	"strip_comments", "keep_docstrings", "include_docstrings", "include_decorators",
+	"include_callees", "include_blame", "neighbor_context", "truncation",
+	"max_prompt_bytes", "max_prompt_tokens", "prompt_overflow", "seed", "deterministic",
+	"max_output_tokens", "stop", "finding_delimiter", "anonymize_paths", "section_separator",
+}
+
+// resumeKey はガイドラインのハッシュと resumeKeys の値から、state_file の
+// 記録を再利用できるかを判定するためのキーを返す。
+func resumeKey(guidelineHash string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", guidelineHash)
+	for _, k := range resumeKeys {
+		fmt.Fprintf(h, "%s=%v\x00", k, viper.Get(k))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// stateEntry は state_file の 1 行。レビューを終えたチャンクとその節、
+// 再開時にレポートの集計へ戻す指摘の件数など。
+type stateEntry struct {
+	ID       string   `json:"id"`
+	Section  string   `json:"section"`
+	Findings int      `json:"findings,omitempty"` // finding_delimiter で区切られた指摘の数
+	Clean    string   `json:"clean,omitempty"`    // 指摘がなかった場合の Clean 節の項目
+	Issues   []string `json:"issues,omitempty"`   // 正規化した指摘の見出し
+}
+
+// runState は state_file に記録したチャンクごとの完了状態。中断後に
+// --resume で再実行した際、完了済みのチャンクを再レビューせずに済ませる。
+// 記録は jsonlWriter で書くため、並行に記録しても行は混ざらない。
+type runState struct {
+	f    *os.File
+	out  *jsonlWriter
+	mu   sync.Mutex            // done を保護する
+	done map[string]stateEntry // チャンク ID ごとの記録
+}
+
+// openRunState は path の状態ファイルを開く。resume が true なら既存の
+// 記録を読み込んで追記し、false なら記録を破棄して新しく始める。
+func openRunState(path string, resume bool) (*runState, error) {
+	s := &runState{done: map[string]stateEntry{}}
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		flag = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if err := s.load(path); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open state_file: %w", err)
+	}
+	s.f, s.out = f, newJSONLWriter(f)
+	return s, nil
+}
+
+// load は状態ファイルの記録を読み込む。ファイルがなければ何もしない。
+// 書き込み途中で中断した末尾の行は読み飛ばす。
+func (s *runState) load(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read state_file: %w", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 16*1024*1024)
+	for sc.Scan() {
+		var e stateEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil && e.ID != "" {
+			s.done[e.ID] = e
+		}
+	}
+	return sc.Err()
+}
+
+// lookup は完了済みのチャンクであればその記録を返す。
+func (s *runState) lookup(id string) (stateEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.done[id]
+	return e, ok
+}
+
+// record はチャンクの完了を状態ファイルへ追記する。クラッシュしても
+// 記録が残るよう、1 件ごとにディスクへ同期する。
+func (s *runState) record(e stateEntry) error {
+	if err := s.out.Encode(e); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.done[e.ID] = e
+	s.mu.Unlock()
+	return s.f.Sync()
+}
+
+// Close は状態ファイルを閉じる。
+func (s *runState) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,177 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestChunkIDStableAcrossRootSpelling(t *testing.T) {
+	fn := Chunk{Name: "F", Code: []byte("func F() {}")}
+	abs, err := filepath.Abs("repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := chunkID("repo", filepath.Join("repo", "pkg", "a.go"), fn)
+	b := chunkID("./repo/", "./repo/pkg/a.go", fn)
+	c := chunkID(abs, filepath.Join(abs, "pkg", "a.go"), fn)
+	if a != b || a != c {
+		t.Errorf("chunkID differs by root spelling: %s %s %s", a, b, c)
+	}
+	if d := chunkID("repo", filepath.Join("repo", "pkg", "b.go"), fn); d == a {
+		t.Error("chunkID ignores the relative path")
+	}
+}
+
+func TestChunkIDIgnoresLayoutButNotPythonIndentation(t *testing.T) {
+	goA := Chunk{Name: "F", StartLine: 1, Code: []byte("func F() {\n\treturn\n}")}
+	goB := Chunk{Name: "F", StartLine: 40, Code: []byte("func F()  {\r\n    return  \r\n\r\n}")}
+	if chunkID("r", "r/a.go", goA) != chunkID("r", "r/a.go", goB) {
+		t.Error("Go chunk ID changed with whitespace or line numbers")
+	}
+	pyA := Chunk{Name: "f", Code: []byte("def f(x):\n    if x:\n        a()\n    b()\n")}
+	pyB := Chunk{Name: "f", Code: []byte("def f(x):\n    if x:\n        a()\n        b()\n")}
+	if chunkID("r", "r/a.py", pyA) == chunkID("r", "r/a.py", pyB) {
+		t.Error("Python chunks differing only in indentation share an ID")
+	}
+	pyC := Chunk{Name: "f", Code: []byte("def f(x):  \r\n    if x:\r\n        a()\r\n\r\n    b()\r\n")}
+	if chunkID("r", "r/a.py", pyA) != chunkID("r", "r/a.py", pyC) {
+		t.Error("Python chunk ID changed with line endings or trailing spaces")
+	}
+}
+
+// resumeFixture は指摘のあるチャンクとないチャンクを 1 つずつ含むリポジトリ。
+// finding_delimiter に "return" を指定すると has_finding だけが指摘を持つ。
+var resumeFixture = map[string]string{
+	"a.py": "def has_finding(x):\n    return x\n\n\ndef clean(x):\n    pass\n",
+}
+
+// keepStateLines は中断を模して、状態ファイルの先頭 n 行だけを残す。
+func keepStateLines(t *testing.T, path string, n int) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	if len(lines) < n {
+		t.Fatalf("state_file has %d lines, want at least %d", len(lines), n)
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines[:n], "")), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeRestoresFindingCounts(t *testing.T) {
+	for _, keep := range []int{1, 2} {
+		dir := t.TempDir()
+		writeTree(t, dir, resumeFixture)
+		state := filepath.Join(t.TempDir(), "state.jsonl")
+		full := reviewEcho(t, dir, map[string]any{"state_file": state, "finding_delimiter": "return"})
+		keepStateLines(t, state, keep)
+		viper.Set("resume", true)
+		resumed := runReview(t, dir)
+		want := fmt.Sprintf("- Resumed from state_file: %d chunks\n", keep)
+		if !strings.Contains(resumed, want) {
+			t.Fatalf("keep=%d: missing %q:\n%s", keep, want, resumed)
+		}
+		if !strings.Contains(full, "Findings: 1") || !strings.Contains(full, "# Clean") {
+			t.Fatalf("fixture does not produce findings and a clean chunk:\n%s", full)
+		}
+		if got := strings.Replace(resumed, want, "", 1); got != full {
+			t.Errorf("keep=%d: resumed report differs from the full run\n--- full\n%s\n--- resumed\n%s", keep, full, got)
+		}
+	}
+}
+
+func TestResumeIgnoresRecordsFromDifferentSettings(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, resumeFixture)
+	state := filepath.Join(t.TempDir(), "state.jsonl")
+	reviewEcho(t, dir, map[string]any{"state_file": state})
+	viper.Set("resume", true)
+	viper.Set("review_language", "Japanese")
+	if report := runReview(t, dir); strings.Contains(report, "Resumed from state_file") {
+		t.Errorf("records reused after review_language changed:\n%s", report)
+	}
+}
+
+func TestRunStateRecordConcurrently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.jsonl")
+	s, err := openRunState(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers, perWorker = 16, 20
+	section := strings.Repeat("x", 8192) // 1 回の書き込みが分割されうる大きさにする
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWorker {
+				id := fmt.Sprintf("w%d-%d", w, i)
+				if err := s.record(stateEntry{ID: id, Section: section}); err != nil {
+					t.Error(err)
+				}
+				if _, ok := s.lookup(id); !ok {
+					t.Errorf("%s not found after record", id)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1024*1024)
+	seen := map[string]bool{}
+	for n := 1; sc.Scan(); n++ {
+		var e stateEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("line %d is not valid JSON: %v", n, err)
+		}
+		seen[e.ID] = true
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != workers*perWorker {
+		t.Errorf("state_file has %d records, want %d", len(seen), workers*perWorker)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"sync"
+	"unicode/utf8"
+)
+
+// Tokenizer はテキストのトークン数を数える。max_prompt_tokens の判定などに
+// 用いられ、既定ではおおよその値を返す簡易実装が使われる。モデル固有の
+// トークナイザで正確に数えたい場合は SetTokenizer で差し替える。
+type Tokenizer interface {
+	Count(text string) int
+}
+
+// heuristicTokenizer は ASCII の 4 文字を 1 トークンとみなす既定の見積もり。
+// 英文やコードではおおむね実際のトークン数に近い値になる。
+type heuristicTokenizer struct{}
+
+func (heuristicTokenizer) Count(text string) int {
+	ascii, multi := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			// マルチバイト文字は 1 文字 1 トークン程度になるため 1 文字ずつ数える
+			multi++
+		}
+	}
+	return (ascii+3)/4 + multi
+}
+
+var (
+	tokenizerMu sync.RWMutex
+	tokenizer   Tokenizer = heuristicTokenizer{}
+)
+
+// SetTokenizer はトークン数の見積もりに使う Tokenizer を差し替える。
+// nil を渡すと既定の簡易実装に戻す。
+func SetTokenizer(t Tokenizer) {
+	tokenizerMu.Lock()
+	defer tokenizerMu.Unlock()
+	if t == nil {
+		t = heuristicTokenizer{}
+	}
+	tokenizer = t
+}
+
+// estimateTokens は現在の Tokenizer で text のトークン数を見積もる。
+func estimateTokens(text string) int {
+	tokenizerMu.RLock()
+	defer tokenizerMu.RUnlock()
+	return tokenizer.Count(text)
+}
@@ -0,0 +1,67 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHeuristicTokenizerCount(t *testing.T) {
+	tests := map[string]int{
+		"":                       0,
+		"abcd":                   1,
+		"abcde":                  2,
+		strings.Repeat("x", 400): 100,
+		"日本語":                    3,
+		"コード review":             5,
+	}
+	for text, want := range tests {
+		if got := (heuristicTokenizer{}).Count(text); got != want {
+			t.Errorf("Count(%q) = %d, want %d", text, got, want)
+		}
+	}
+}
+
+// wordTokenizer は空白区切りの語を 1 トークンと数えるテスト用の Tokenizer。
+type wordTokenizer struct{}
+
+func (wordTokenizer) Count(text string) int { return len(strings.Fields(text)) }
+
+func TestSetTokenizerDrivesPromptTokenLimit(t *testing.T) {
+	SetTokenizer(wordTokenizer{})
+	t.Cleanup(func() { SetTokenizer(nil) })
+	if got := estimateTokens("one two three"); got != 3 {
+		t.Errorf("estimateTokens = %d, want the stub's count 3", got)
+	}
+	resetConfig(t, map[string]any{"max_prompt_tokens": 3})
+	if over := promptOverLimit("one two three"); over != nil {
+		t.Errorf("3 words reported over a 3-token limit: %v", over)
+	}
+	if over := promptOverLimit("one two three four"); over == nil || over.Key != "max_prompt_tokens" {
+		t.Errorf("4 words not reported over the limit: %v", over)
+	}
+	SetTokenizer(nil)
+	if got := estimateTokens("one two three"); got != (heuristicTokenizer{}).Count("one two three") {
+		t.Errorf("SetTokenizer(nil) did not restore the heuristic: %d", got)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+// truncation に指定できる値。上限を超えるチャンクのコードをどう切り詰めるかを
+// 表す。skip（既定）は切り詰めずにチャンクを読み飛ばす。
+const (
+	truncateSkip     = "skip"
+	truncateHead     = "head"
+	truncateTail     = "tail"
+	truncateHeadTail = "head_tail"
+)
+
+// validateTruncation は truncation の値を検証する。prompt_overflow: skip は
+// 文脈を外すことも切り詰めることもせずに読み飛ばす指定で truncation より
+// 優先されるため、skip 以外の truncation との併用は誤りとして扱う。
+func validateTruncation() error {
+	switch strategy := viper.GetString("truncation"); strategy {
+	case "", truncateSkip:
+		return nil
+	case truncateHead, truncateTail, truncateHeadTail:
+		if viper.GetString("prompt_overflow") == "skip" {
+			return fmt.Errorf("truncation %q has no effect with prompt_overflow: skip", strategy)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid truncation %q (want skip, head, tail or head_tail)", strategy)
+	}
+}
+
+// truncatedMarkerFormat は切り詰めたコードで省略箇所に置く行。
+const truncatedMarkerFormat = "... (%d lines truncated) ..."
+
+// truncateLines は lines のうち keep 行だけを strategy に従って残す。head は
+// 先頭、tail は末尾、head_tail は先頭と末尾を半分ずつ残し、省略した位置に
+// 省略行数を示す行を置く。
+func truncateLines(lines []string, keep int, strategy string) string {
+	if keep >= len(lines) {
+		return strings.Join(lines, "\n")
+	}
+	marker := fmt.Sprintf(truncatedMarkerFormat, len(lines)-keep)
+	var kept []string
+	switch strategy {
+	case truncateHead:
+		kept = append(append(kept, lines[:keep]...), marker)
+	case truncateTail:
+		kept = append(append(kept, marker), lines[len(lines)-keep:]...)
+	default:
+		head := (keep + 1) / 2
+		kept = append(append(append(kept, lines[:head]...), marker), lines[len(lines)-(keep-head):]...)
+	}
+	return strings.Join(kept, "\n")
+}
+
+// truncatePrompt は truncation の方針に従ってチャンクのコードを切り詰め、
+// 上限に収まる範囲でできるだけ多くの行を残したプロンプトを返す。あわせて
+// 省略した行数を返す。1 行も残せない場合は over をそのまま返す。strategy は
+// validateTruncation で検証済みであること。
+func truncatePrompt(tmpl *template.Template, lang string, fn Chunk, strategy string, over *PromptTooLargeError) (string, int, error) {
+	lines := strings.Split(string(fn.Code), "\n")
+	// 残す行数を二分探索し、上限に収まる最大の行数を求める
+	lo, hi := 0, len(lines)-1
+	best := ""
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		fn.Code = []byte(truncateLines(lines, mid, strategy))
+		prompt, err := buildPrompt(tmpl, lang, fn)
+		if err != nil {
+			return "", 0, err
+		}
+		if promptOverLimit(prompt) == nil {
+			lo, best = mid, prompt
+		} else {
+			hi = mid - 1
+		}
+	}
+	if best == "" {
+		return "", 0, over
+	}
+	return best, len(lines) - lo, nil
+}
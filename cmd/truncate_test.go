@@ -0,0 +1,140 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTruncateLines(t *testing.T) {
+	lines := []string{"l1", "l2", "l3", "l4", "l5", "l6"}
+	marker := fmt.Sprintf(truncatedMarkerFormat, 3)
+	tests := []struct {
+		strategy string
+		want     []string
+	}{
+		{truncateHead, []string{"l1", "l2", "l3", marker}},
+		{truncateTail, []string{marker, "l4", "l5", "l6"}},
+		{truncateHeadTail, []string{"l1", "l2", marker, "l6"}},
+	}
+	for _, tt := range tests {
+		if got := truncateLines(lines, 3, tt.strategy); got != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got %q, want %q", tt.strategy, got, tt.want)
+		}
+	}
+	if got := truncateLines(lines, 6, truncateHead); got != strings.Join(lines, "\n") {
+		t.Errorf("lines within the limit were truncated: %q", got)
+	}
+}
+
+func TestValidateTruncation(t *testing.T) {
+	tests := []struct {
+		truncation, overflow string
+		ok                   bool
+	}{
+		{"", "", true},
+		{truncateSkip, "skip", true},
+		{truncateHeadTail, "", true},
+		{truncateHead, "skip", false},
+		{"middle", "", false},
+	}
+	for _, tt := range tests {
+		resetConfig(t, map[string]any{"truncation": tt.truncation, "prompt_overflow": tt.overflow})
+		if err := validateTruncation(); (err == nil) != tt.ok {
+			t.Errorf("truncation=%q prompt_overflow=%q: err = %v, want ok=%v", tt.truncation, tt.overflow, err, tt.ok)
+		}
+	}
+}
+
+func TestReviewTruncatesOversizedChunk(t *testing.T) {
+	var body strings.Builder
+	for i := 1; i <= 40; i++ {
+		fmt.Fprintf(&body, "    step_%02d()\n", i)
+	}
+	for _, tt := range []struct {
+		strategy    string
+		first, last bool
+	}{
+		{truncateHead, true, false},
+		{truncateTail, false, true},
+		{truncateHeadTail, true, true},
+	} {
+		dir := t.TempDir()
+		writeTree(t, dir, map[string]string{"a.py": "def big():\n" + body.String()})
+		report := reviewEcho(t, dir, map[string]any{"max_prompt_bytes": 200, "truncation": tt.strategy})
+		if !strings.Contains(report, "code truncated to fit the prompt limit (truncation: "+tt.strategy+")") {
+			t.Fatalf("%s: truncation note missing:\n%s", tt.strategy, report)
+		}
+		if strings.Contains(report, "step_01") != tt.first || strings.Contains(report, "step_40") != tt.last {
+			t.Errorf("%s: kept the wrong end of the chunk:\n%s", tt.strategy, report)
+		}
+	}
+}
+
+func TestReviewRejectsTruncationWithSkippedOverflow(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, mixedFixture)
+	echoConfig(t, map[string]any{"truncation": truncateHead, "prompt_overflow": "skip"})
+	if err := Review(t.Context(), dir, filepath.Join(t.TempDir(), "report.md")); err == nil {
+		t.Error("Review accepted truncation together with prompt_overflow: skip")
+	}
+}
+
+func TestReviewPromptLimitDropsContextOrSkips(t *testing.T) {
+	long := strings.Repeat("x", 80)
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.py": "def helper_" + long + "():\n    pass\n\n\ndef target():\n    return 1\n",
+	})
+	const tmpl = "{{.neighbors}}---\n{{.code}}"
+	summary := filepath.Join(t.TempDir(), "summary.md")
+	t.Setenv("GITHUB_STEP_SUMMARY", summary)
+
+	// 既定では近傍の文脈を外して上限に収める
+	templateConfig(t, tmpl, map[string]any{"neighbor_context": 1, "max_prompt_bytes": 60})
+	report := runReview(t, dir)
+	if !strings.Contains(report, "---\ndef target():") {
+		t.Fatalf("target not reviewed after dropping context:\n%s", report)
+	}
+	if strings.Contains(report, "after: def helper_") || strings.Contains(report, "before: def helper_") {
+		t.Errorf("optional context kept in an oversized prompt:\n%s", report)
+	}
+
+	// prompt_overflow: skip では文脈を外さずにチャンクを読み飛ばす
+	os.Remove(summary)
+	templateConfig(t, tmpl, map[string]any{"neighbor_context": 1, "max_prompt_bytes": 60, "prompt_overflow": "skip"})
+	report = runReview(t, dir)
+	if strings.Contains(report, "def target():") {
+		t.Errorf("oversized chunk reviewed with prompt_overflow skip:\n%s", report)
+	}
+	got, err := os.ReadFile(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "oversized_chunks=2") {
+		t.Errorf("skipped chunks not counted: %s", got)
+	}
+}
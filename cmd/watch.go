@@ -0,0 +1,277 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// watchDebounce は同じファイルへの連続した保存をまとめる待ち時間。
+const watchDebounce = 500 * time.Millisecond
+
+// watchCmd はファイルの変更を監視して再レビューするサブコマンド
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "ファイルの変更を監視して再レビューする",
+	Long: `リポジトリ配下の対応ファイルを監視し、保存されたファイルだけを
+再度抽出・レビューしてレポート内の該当節を更新します。
+レポートには監視開始後にレビューしたファイルのみが含まれます。`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cobra.CheckErr(ensureModel())
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		root := repository
+		if root == "" {
+			root = "."
+		}
+		if err := Watch(ctx, root, viper.GetString("output")); err != nil && !errors.Is(err, context.Canceled) {
+			cobra.CheckErr(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+
+	// 監視対象リポジトリを指定するフラグ
+	watchCmd.Flags().StringVarP(&repository, "repository", "r", "", "Repository to watch (default is the current directory)")
+}
+
+// fileRun は r と同じ設定・クライアントを共有し、結果と統計だけを空にした
+// 実行を返す。watch では 1 ファイルぶんの結果をこれで個別に保持し、変更の
+// たびに差し替えることで、件数や費用が保存のたびに積み上がらないようにする。
+func (r *reviewRun) fileRun() *reviewRun {
+	c := *r
+	c.report, c.todoReport, c.suppressed, c.clean = nil, nil, nil, nil
+	c.partialFiles, c.reviewed, c.failed, c.stripped, c.oversized, c.resumed, c.findings = 0, 0, 0, 0, 0, 0, 0
+	c.issues, c.languages, c.usage, c.skips = nil, nil, nil, nil
+	return &c
+}
+
+// merge は o の節と統計を r に加える。
+func (r *reviewRun) merge(o *reviewRun) {
+	r.report = append(r.report, o.report...)
+	r.todoReport = append(r.todoReport, o.todoReport...)
+	r.suppressed = append(r.suppressed, o.suppressed...)
+	r.clean = append(r.clean, o.clean...)
+	r.partialFiles += o.partialFiles
+	r.reviewed += o.reviewed
+	r.failed += o.failed
+	r.stripped += o.stripped
+	r.oversized += o.oversized
+	r.resumed += o.resumed
+	r.findings += o.findings
+	for t, n := range o.issues {
+		if r.issues == nil {
+			r.issues = map[string]int{}
+		}
+		r.issues[t] += n
+	}
+	for l, st := range o.languages {
+		sum := r.langStats(l)
+		sum.files += st.files
+		sum.chunks += st.chunks
+	}
+	for m, u := range o.usage {
+		r.addUsage(m, reviewResult{PromptTokens: u.prompt, OutputTokens: u.output})
+	}
+	for reason, n := range o.skips {
+		if r.skips == nil {
+			r.skips = map[string]int{}
+		}
+		r.skips[reason] += n
+	}
+}
+
+// mergeRuns はファイルごとの結果をパス順に base の空の実行へまとめる。
+func mergeRuns(base *reviewRun, files map[string]*reviewRun) *reviewRun {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	merged := base.fileRun()
+	for _, p := range paths {
+		merged.merge(files[p])
+	}
+	return merged
+}
+
+// Watch は repoRoot 配下を監視し、変更されたファイルを再レビューして outFile を
+// 更新し続ける。ctx がキャンセルされるまで戻らない。
+func Watch(ctx context.Context, repoRoot, outFile string) error {
+	if viper.GetBool("append") {
+		// 変更のたびにレポート全体を書き直すため追記モードは使わない
+		log.Printf("Ignoring append mode in watch")
+		viper.Set("append", false)
+	}
+	run, err := newReviewRun(repoRoot)
+	if err != nil {
+		return err
+	}
+	filter, err := newWalkFilter(repoRoot)
+	if err != nil {
+		return err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := addWatchDirs(w, filter, repoRoot); err != nil {
+		return err
+	}
+	log.Printf("Watching %s", repoRoot)
+
+	outAbs, _ := filepath.Abs(outFile)
+	changed := make(chan string)
+	timers := map[string]*time.Timer{}
+	files := map[string]*reviewRun{} // ファイルごとの最新のレビュー結果
+	save := func() error {
+		if err := mergeRuns(run, files).save(outFile, run.seed); err != nil {
+			return err
+		}
+		log.Printf("Report updated: %s", outFile)
+		return nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-w.Errors:
+			log.Printf("Watch error: %v", err)
+		case ev := <-w.Events:
+			if abs, _ := filepath.Abs(ev.Name); isReportFile(abs, outAbs) {
+				continue // 自身が書き出したレポート（分割したものを含む）は無視する
+			}
+			if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+				// 削除・移動されたファイル（ディレクトリなら配下すべて）の節を外す
+				if removeWatched(files, ev.Name) {
+					if err := save(); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Create) {
+				continue
+			}
+			info, err := os.Stat(ev.Name)
+			if err != nil {
+				continue
+			}
+			if info.IsDir() {
+				// 新しく作られたディレクトリも、除外や max_depth に当たらなければ監視対象に加える
+				if filter.skipDir(ev.Name, info.Name()) {
+					continue
+				}
+				if err := addWatchDirs(w, filter, ev.Name); err != nil {
+					log.Printf("Watch error %s: %v", ev.Name, err)
+				}
+				continue
+			}
+			if filter.skip(ev.Name, info.Name(), false) {
+				continue
+			}
+			// 連続した保存は最後のイベントから watchDebounce 経過後に 1 回だけ処理する
+			path := ev.Name
+			if t, ok := timers[path]; ok {
+				t.Stop()
+			}
+			timers[path] = time.AfterFunc(watchDebounce, func() {
+				select {
+				case changed <- path:
+				case <-ctx.Done():
+				}
+			})
+		case path := <-changed:
+			delete(timers, path)
+			if _, err := os.Stat(path); err != nil {
+				// 待っている間に削除されたファイルはレビューしない
+				continue
+			}
+			fr := run.fileRun()
+			// 再試行の予算は複製した実行とも共有される
+			if err := fr.processFile(ctx, path, nil); err != nil {
+				if isInterrupted(err) {
+					return err
+				}
+				log.Printf("Review error %s: %v", path, err)
+				continue
+			}
+			files[path] = fr
+			if err := save(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// removeWatched は削除・移動された path と、その配下のファイルの結果を
+// files から外す。外した結果があれば true を返す。
+func removeWatched(files map[string]*reviewRun, path string) bool {
+	removed := false
+	prefix := path + string(filepath.Separator)
+	for p := range files {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(files, p)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// addWatchDirs は dir 以下の除外されていないディレクトリをすべて監視に加える。
+// 一括レビューの探索と同じく max_depth より深いディレクトリは監視しない。
+func addWatchDirs(w *fsnotify.Watcher, filter *walkFilter, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if filter.skipDir(path, d.Name()) {
+			return fs.SkipDir
+		}
+		if err := w.Add(path); err != nil {
+			return fmt.Errorf("watch %s: %w", path, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,148 @@
+/*
+Copyright © 2025 ramsesyok
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeRunsRecomputesStats(t *testing.T) {
+	base := &reviewRun{}
+	a := base.fileRun()
+	a.report = []string{"## a\n\n"}
+	a.reviewed, a.findings = 2, 3
+	a.issues = map[string]int{"magic number": 2}
+	a.langStats("py").files, a.langStats("py").chunks = 1, 2
+	a.addUsage("m", reviewResult{PromptTokens: 10, OutputTokens: 5})
+	a.countSkip(skipTooLarge)
+	b := base.fileRun()
+	b.report = []string{"## b\n\n"}
+	b.reviewed, b.failed = 1, 1
+	b.issues = map[string]int{"magic number": 1}
+	b.langStats("py").files, b.langStats("py").chunks = 1, 1
+
+	files := map[string]*reviewRun{"b.py": b, "a.py": a}
+	for i := 0; i < 2; i++ {
+		// 何度まとめ直しても件数が積み上がらないこと
+		m := mergeRuns(base, files)
+		if strings.Join(m.report, "") != "## a\n\n## b\n\n" {
+			t.Errorf("report = %q", m.report)
+		}
+		if m.reviewed != 3 || m.failed != 1 || m.findings != 3 {
+			t.Errorf("reviewed=%d failed=%d findings=%d", m.reviewed, m.failed, m.findings)
+		}
+		if m.issues["magic number"] != 3 || *m.languages["py"] != (languageStats{files: 2, chunks: 3}) {
+			t.Errorf("issues=%v languages=%+v", m.issues, *m.languages["py"])
+		}
+		if *m.usage["m"] != (tokenUsage{prompt: 10, output: 5}) || m.skips[skipTooLarge] != 1 {
+			t.Errorf("usage=%+v skips=%v", *m.usage["m"], m.skips)
+		}
+	}
+	if base.reviewed != 0 || base.report != nil {
+		t.Error("mergeRuns modified the base run")
+	}
+}
+
+// waitForReport は report が cond を満たすまで待ち、その内容を返す。
+func waitForReport(t *testing.T, path string, cond func(string) bool) string {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	var last string
+	for time.Now().Before(deadline) {
+		if b, err := os.ReadFile(path); err == nil {
+			last = string(b)
+			if cond(last) {
+				return last
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("report did not reach the expected state:\n%s", last)
+	return ""
+}
+
+func TestWatchReplacesAndRemovesFileSections(t *testing.T) {
+	root := t.TempDir()
+	echoConfig(t, nil)
+	out := filepath.Join(t.TempDir(), "report.md")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Watch(ctx, root, out) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	time.Sleep(200 * time.Millisecond) // 監視の開始を待つ
+
+	src := filepath.Join(root, "a.py")
+	writeTree(t, root, map[string]string{"a.py": "def first():\n    pass\n"})
+	waitForReport(t, out, func(r string) bool { return strings.Contains(r, "first") })
+
+	writeTree(t, root, map[string]string{"a.py": "def second():\n    pass\n"})
+	report := waitForReport(t, out, func(r string) bool { return strings.Contains(r, "second") })
+	if strings.Contains(report, "first") {
+		t.Errorf("stale section kept after the file changed:\n%s", report)
+	}
+	if !strings.Contains(report, "| py | 1 | 1 |") {
+		t.Errorf("language stats accumulated across saves:\n%s", report)
+	}
+
+	if err := os.Remove(src); err != nil {
+		t.Fatal(err)
+	}
+	waitForReport(t, out, func(r string) bool { return !strings.Contains(r, "second") })
+}
+
+func TestWatchSkipsDirectoriesDeeperThanMaxDepth(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	echoConfig(t, map[string]any{"max_depth": 1})
+	out := filepath.Join(t.TempDir(), "report.md")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Watch(ctx, root, out) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	time.Sleep(200 * time.Millisecond) // 監視の開始を待つ
+
+	// 監視開始後に作られた深いディレクトリも監視しない
+	writeTree(t, root, map[string]string{
+		"a/b/deep.py":  "def deep():\n    pass\n",
+		"c/d/later.py": "def later():\n    pass\n",
+		"a/shallow.py": "def shallow():\n    pass\n",
+	})
+	time.Sleep(200 * time.Millisecond)
+	writeTree(t, root, map[string]string{"a/shallow.py": "def shallow_edited():\n    pass\n", "c/d/later.py": "def later_edited():\n    pass\n"})
+	report := waitForReport(t, out, func(r string) bool { return strings.Contains(r, "shallow_edited") })
+	if strings.Contains(report, "deep") || strings.Contains(report, "later") {
+		t.Errorf("file deeper than max_depth reviewed in watch mode:\n%s", report)
+	}
+}
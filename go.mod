@@ -4,6 +4,7 @@ go 1.24.3
 
 require (
 	github.com/briandowns/spinner v1.23.2
+	github.com/fsnotify/fsnotify v1.8.0
 	github.com/ollama/ollama v0.9.6
 	github.com/smacker/go-tree-sitter v0.0.0-20240827094217-dd81d9e9be82
 	github.com/spf13/cobra v1.9.1
@@ -12,7 +13,6 @@ require (
 
 require (
 	github.com/fatih/color v1.7.0 // indirect
-	github.com/fsnotify/fsnotify v1.8.0 // indirect
 	github.com/go-viper/mapstructure/v2 v2.2.1 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.2 // indirect